@@ -1,5 +1,7 @@
 package main
 
+import "encoding/json"
+
 type message struct {
 	TimeNano int64     `json:"time"`
 	Tag      string    `json:"tag"`
@@ -12,11 +14,44 @@ type APIResponse struct {
 	Start   int64   `json:"start"`
 	End     int64   `json:"end"`
 	Samples Samples `json:"samples"`
+	// rows, that were acknowledged before it, are visible, ns
+	VisibleUntil int64 `json:"visibleUntil"`
+}
+
+// namedResponse is APIResponse of a tag with a schema, its samples' values
+// are keyed by field name
+type namedResponse struct {
+	TagName      string        `json:"tagName"`
+	Start        int64         `json:"start"`
+	End          int64         `json:"end"`
+	Samples      []namedSample `json:"samples"`
+	VisibleUntil int64         `json:"visibleUntil"`
+}
+
+type namedSample struct {
+	Time   int64                  `json:"time"`
+	Values map[string]interface{} `json:"values"`
 }
 
 type sample struct {
 	Time   int64     `json:"time"`
 	Values []float64 `json:"values"`
+	// values of tags with typed schema fields, instead of `Values`
+	Typed []interface{} `json:"-"`
+}
+
+// MarshalJSON writes NaN values, of fields without one, as nulls
+func (s sample) MarshalJSON() ([]byte, error) {
+	type plain sample
+
+	if !hasNaN(s.Values) {
+		return json.Marshal(plain(s))
+	}
+
+	return json.Marshal(struct {
+		Time   int64         `json:"time"`
+		Values []interface{} `json:"values"`
+	}{s.Time, nullNaN(s.Values)})
 }
 
 // Samples holds samples
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v2"
+)
+
+// scopes, that an API key can be granted
+type scope uint8
+
+const (
+	scopeIngest scope = 1 << iota
+	scopeQuery
+	scopeAdmin
+)
+
+var scopeNames = map[string]scope{"ingest": scopeIngest, "query": scopeQuery, "admin": scopeAdmin}
+
+// apiKey as it's stored in `auth.keysFile`:
+//
+//	keys:
+//	  - name: sensors
+//	    key: 7c1f...
+//	    cert: sensors.example.com
+//	    tenant: acme
+//	    scopes: [ingest]
+//	    tags: [sensor.]
+//
+// `cert` is the common name of a verified client certificate, that is
+// authorized as this key without `X-API-Key` header. `tenant` namespaces
+// the key's tags, admin keys without one can pick it in `X-Tenant`
+// header. empty `tags` allow all of them
+type apiKey struct {
+	Name   string   `yaml:"name"`
+	Key    string   `yaml:"key"`
+	Cert   string   `yaml:"cert"`
+	Tenant string   `yaml:"tenant"`
+	Scopes []string `yaml:"scopes"`
+	Tags   []string `yaml:"tags"`
+
+	scopes scope
+}
+
+// allows tells if `tag` starts with one of the key's tag prefixes
+func (k *apiKey) allows(tag string) bool {
+	if len(k.Tags) == 0 {
+		return true
+	}
+
+	for _, p := range k.Tags {
+		if strings.HasPrefix(tag, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (k *apiKey) can(s scope) bool {
+	return k.scopes&s != 0
+}
+
+// keyStore holds API keys loaded from a YAML file, and reloads them once
+// the file changes. lookups don't lock, so failed requests stay cheap on
+// the ingest path
+type keyStore struct {
+	path string
+	keys atomic.Value // keySet
+}
+
+// API keys by `key` and by client certificate name
+type keySet struct {
+	byKey  map[string]*apiKey
+	byCert map[string]*apiKey
+}
+
+// loadKeys reads API keys from `path`
+func loadKeys(path string) (*keyStore, error) {
+	ks := &keyStore{path: path}
+
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// reload replaces keys with the file contents, keeping the old ones if the
+// file can't be read or is invalid
+func (ks *keyStore) reload() error {
+	data, err := ioutil.ReadFile(ks.path)
+
+	if err != nil {
+		return err
+	}
+
+	var file struct {
+		Keys []*apiKey `yaml:"keys"`
+	}
+
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("can't parse %s: %v", ks.path, err)
+	}
+
+	keys := keySet{make(map[string]*apiKey), make(map[string]*apiKey)}
+
+	for _, k := range file.Keys {
+		if k.Key == "" && k.Cert == "" {
+			return fmt.Errorf("key %q has neither key nor cert", k.Name)
+		}
+
+		if _, ok := keys.byKey[k.Key]; ok && k.Key != "" {
+			return fmt.Errorf("key %q is duplicated", k.Name)
+		}
+
+		if _, ok := keys.byCert[k.Cert]; ok && k.Cert != "" {
+			return fmt.Errorf("cert of key %q is duplicated", k.Name)
+		}
+
+		for _, s := range k.Scopes {
+			bit, ok := scopeNames[s]
+
+			if !ok {
+				return fmt.Errorf("key %q has unknown scope %q", k.Name, s)
+			}
+
+			k.scopes |= bit
+		}
+
+		if k.Key != "" {
+			keys.byKey[k.Key] = k
+		}
+
+		if k.Cert != "" {
+			keys.byCert[k.Cert] = k
+		}
+	}
+
+	ks.keys.Store(keys)
+
+	return nil
+}
+
+// watch reloads keys once the file changes, checking it each `interval`.
+// runs forever, meant to be started in a goroutine
+func (ks *keyStore) watch(interval time.Duration) {
+	watchFiles("API keys", interval, ks.reload, ks.path)
+}
+
+func (ks *keyStore) get() keySet {
+	return ks.keys.Load().(keySet)
+}
+
+// lookup returns the key, sent in `X-API-Key` header, or the one mapped to
+// the client certificate, if there's no header. nil if there's neither
+func (ks *keyStore) lookup(ctx *fasthttp.RequestCtx) *apiKey {
+	if key := ctx.Request.Header.Peek("X-API-Key"); len(key) > 0 {
+		// map lookup by string(key) conversion doesn't allocate
+		return ks.get().byKey[string(key)]
+	}
+
+	if name := clientCertName(ctx); name != "" {
+		return ks.get().byCert[name]
+	}
+
+	return nil
+}
+
+// scope, required for each path. paths not listed are public
+func scopeOf(path string) scope {
+	switch {
+	case path == "/save":
+		return scopeIngest
+	case path == "/api" || path == "/tags" || path == "/export":
+		return scopeQuery
+	case strings.HasPrefix(path, "/admin/"):
+		return scopeAdmin
+	}
+
+	return 0
+}
+
+// authorize checks `X-API-Key` header or client certificate against `path`
+// scope and `/api` or `/export` tag, responding with 401 or 403 if it
+// fails. the key is stored in ctx as "apiKey", `/save` checks message tag
+// against it after decoding. all requests are authorized, when `ks` is nil
+func (ks *keyStore) authorize(ctx *fasthttp.RequestCtx, path string) bool {
+	required := scopeOf(path)
+
+	if ks == nil || required == 0 {
+		return true
+	}
+
+	k := ks.lookup(ctx)
+
+	if k == nil {
+		authFailures.inc("key")
+		ctx.Error("missing or unknown API key", fasthttp.StatusUnauthorized)
+		return false
+	}
+
+	if !k.can(required) {
+		authFailures.inc("scope")
+		ctx.Error("API key isn't allowed to access "+path, fasthttp.StatusForbidden)
+		return false
+	}
+
+	if (path == "/api" || path == "/export") && !k.allows(string(ctx.QueryArgs().Peek("tag"))) {
+		authFailures.inc("tag")
+		ctx.Error("API key isn't allowed to access this tag", fasthttp.StatusForbidden)
+		return false
+	}
+
+	ctx.SetUserValue("apiKey", k)
+
+	return true
+}
+
+// clientName identifies the client in logs: name of its API key, or of its
+// client certificate. empty for anonymous clients
+func clientName(ctx *fasthttp.RequestCtx) string {
+	if k, ok := ctx.UserValue("apiKey").(*apiKey); ok {
+		return k.Name
+	}
+
+	return clientCertName(ctx)
+}
+
+// tagAllowed tells if the request's API key, if there's one, allows `tag`
+func tagAllowed(ctx *fasthttp.RequestCtx, tag string) bool {
+	k, ok := ctx.UserValue("apiKey").(*apiKey)
+
+	return !ok || k.allows(tag)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+const testKeys = `
+keys:
+  - name: sensors
+    key: ingest-key
+    scopes: [ingest]
+    tags: [sensor.]
+  - name: dashboard
+    key: query-key
+    scopes: [query]
+    tags: [sensor., test_]
+  - name: ops
+    key: admin-key
+    scopes: [admin]
+`
+
+func writeKeys(t *testing.T, path string, data string) {
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getAuthTestServer(t *testing.T) (*fasthttp.Client, chan Msg, *keyStore, string) {
+	f, err := ioutil.TempFile("", "poc-keys")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	writeKeys(t, f.Name(), testKeys)
+
+	keys, err := loadKeys(f.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := mockDB{}
+	td := getServer(db, newIntake(db.startQueueConsumer()), keys, nil, nil, nil)
+
+	return td.c, td.in, keys, f.Name()
+}
+
+func TestAuthScopes(t *testing.T) {
+	c, in, _, path := getAuthTestServer(t)
+	defer os.Remove(path)
+
+	msg := `{"time":1000,"tag":"sensor.1","values":[1.1]}`
+	api := "http://test.me/api?tag=sensor.1&start=" + formatNow(-time.Hour) + "&end=" + formatNow(0)
+
+	assert.Equal(t, 401, doWithKey(c, "POST", "http://test.me/save", "", msg), "should require a key")
+	assert.Equal(t, 401, doWithKey(c, "POST", "http://test.me/save", "wrong", msg), "should reject unknown keys")
+	assert.Equal(t, 403, doWithKey(c, "POST", "http://test.me/save", "query-key", msg), "query key can't ingest")
+	assert.Equal(t, 200, doWithKey(c, "POST", "http://test.me/save", "ingest-key", msg))
+	assert.Equal(t, "sensor.1", (<-in).Tag)
+
+	assert.Equal(t, 403, doWithKey(c, "GET", api, "ingest-key", ""), "ingest key can't query")
+	assert.Equal(t, 200, doWithKey(c, "GET", api, "query-key", ""))
+
+	assert.Equal(t, 403, doWithKey(c, "GET", "http://test.me/admin/config", "query-key", ""), "query key isn't admin")
+	assert.Equal(t, 200, doWithKey(c, "GET", "http://test.me/admin/config", "admin-key", ""))
+
+	assert.Equal(t, 200, doWithKey(c, "GET", "http://test.me/health/live", "", ""), "health should be public")
+}
+
+func TestAuthTags(t *testing.T) {
+	c, in, _, path := getAuthTestServer(t)
+	defer os.Remove(path)
+
+	assert.Equal(t, 403, doWithKey(c, "POST", "http://test.me/save", "ingest-key", `{"time":1000,"tag":"test_1","values":[1.1]}`), "tag isn't allowed")
+	assert.Equal(t, 0, len(in), "shouldn't send disallowed tags to msgChan")
+
+	api := "http://test.me/api?start=" + formatNow(-time.Hour) + "&end=" + formatNow(0) + "&tag="
+
+	assert.Equal(t, 200, doWithKey(c, "GET", api+"test_1", "query-key", ""))
+	assert.Equal(t, 403, doWithKey(c, "GET", api+"other", "query-key", ""), "tag isn't allowed")
+}
+
+func TestAuthReload(t *testing.T) {
+	c, _, keys, path := getAuthTestServer(t)
+	defer os.Remove(path)
+
+	go keys.watch(10 * time.Millisecond)
+
+	config := "http://test.me/admin/config"
+
+	assert.Equal(t, 401, doWithKey(c, "GET", config, "new-key", ""))
+
+	// make sure mtime changes on filesystems with coarse timestamps
+	writeKeys(t, path, testKeys+"  - name: new\n    key: new-key\n    scopes: [admin]\n")
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+	assert.Equal(t, 200, waitForStatus(c, config, "new-key", 200), "new key should be loaded")
+
+	writeKeys(t, path, "keys: [broken")
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Equal(t, 200, doWithKey(c, "GET", config, "new-key", ""), "should keep keys on invalid file")
+}
+
+func TestLoadKeysErrors(t *testing.T) {
+	f, _ := ioutil.TempFile("", "poc-keys")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	for _, data := range []string{
+		"keys:\n  - name: a\n    key: x\n    scopes: [write]\n",
+		"keys:\n  - name: a\n    scopes: [query]\n",
+		"keys:\n  - name: a\n    key: x\n  - name: b\n    key: x\n",
+	} {
+		writeKeys(t, f.Name(), data)
+
+		_, err := loadKeys(f.Name())
+
+		assert.Error(t, err, data)
+	}
+
+	_, err := loadKeys(f.Name() + ".missing")
+
+	assert.Error(t, err)
+}
+
+func waitForStatus(c *fasthttp.Client, url string, key string, status int) int {
+	code := 0
+
+	for i := 0; i < 100 && code != status; i++ {
+		time.Sleep(10 * time.Millisecond)
+		code = doWithKey(c, "GET", url, key, "")
+	}
+
+	return code
+}
+
+func formatNow(d time.Duration) string {
+	return fmt.Sprint(time.Now().Add(d).UnixNano())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"hash/fnv"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// batch of rows for `.P.tp_add`, with the time its first message was
+// received, to measure ingest lag
+type batch struct {
+	rows     []*kdb.K
+	bytes    int
+	received time.Time
+}
+
+// batcher accumulates rows in one batch per `saveBatch` worker. a tag
+// always goes to the same worker(see `KDB.workerOf`), so its rows reach
+// `tp` in order. a batch is flushed at `maxRows`, `maxBytes` or `maxAge`,
+// whichever comes first
+type batcher struct {
+	parts    []batch
+	maxRows  int
+	maxBytes int
+	maxAge   time.Duration
+}
+
+func newBatcher(workers int, maxRows int, maxBytes int, maxAge time.Duration) *batcher {
+	return &batcher{make([]batch, workers), maxRows, maxBytes, maxAge}
+}
+
+// workerOf returns the worker of `workers`, that handles `tag`
+func workerOf(tag string, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+
+	return int(h.Sum32() % uint32(workers))
+}
+
+// approximate IPC size of a `(tag; ts; values)` row
+func msgSize(m Msg) int {
+	size := 16 + len(m.Tag) + 8 + 8*len(m.Values)
+
+	for _, v := range m.Typed {
+		size += 10
+
+		if s, ok := v.(string); ok {
+			size += len(s)
+		}
+	}
+
+	return size
+}
+
+// add appends `row` to `worker` batch, and returns whether the batch
+// reached `maxRows` or `maxBytes`
+func (b *batcher) add(worker int, m Msg, row *kdb.K) bool {
+	p := &b.parts[worker]
+
+	if len(p.rows) == 0 {
+		p.received = time.Now()
+	}
+
+	p.rows = append(p.rows, row)
+	p.bytes += msgSize(m)
+
+	return len(p.rows) >= b.maxRows || p.bytes >= b.maxBytes
+}
+
+// take returns the worker's batch and starts a new one
+func (b *batcher) take(i int) batch {
+	p := b.parts[i]
+
+	b.parts[i] = batch{}
+
+	return p
+}
+
+// expired returns workers with non empty batches, older than `maxAge`
+func (b *batcher) expired(now time.Time) []int {
+	var res []int
+
+	for i, p := range b.parts {
+		if len(p.rows) > 0 && now.Sub(p.received) >= b.maxAge {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// tick is how often batches are checked for `maxAge`
+func (b *batcher) tick() time.Duration {
+	t := b.maxAge / 10
+
+	if t < 10*time.Millisecond {
+		t = 10 * time.Millisecond
+	}
+
+	if t > b.maxAge {
+		t = b.maxAge
+	}
+
+	return t
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+func batcherRow(m Msg) *kdb.K {
+	return kdb.NewList(kdb.Symbol(m.Tag), kdb.Long(m.Time), kdb.Atom(kdb.KF, m.Values))
+}
+
+func TestBatcherMaxRows(t *testing.T) {
+	b := newBatcher(1, 3, 1<<20, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		m := Msg{int64(i), "tag1", []float64{1}, nil}
+		assert.False(t, b.add(0, m, batcherRow(m)))
+	}
+
+	m := Msg{2, "tag1", []float64{1}, nil}
+
+	assert.True(t, b.add(0, m, batcherRow(m)))
+	assert.Len(t, b.take(0).rows, 3)
+	assert.Len(t, b.parts[0].rows, 0)
+}
+
+func TestBatcherMaxBytes(t *testing.T) {
+	m := Msg{1, "tag1", make([]float64, 10), nil}
+
+	b := newBatcher(1, 1000, 2*msgSize(m), time.Hour)
+
+	assert.False(t, b.add(0, m, batcherRow(m)))
+	assert.True(t, b.add(0, m, batcherRow(m)))
+
+	taken := b.take(0)
+	assert.Equal(t, 2*msgSize(m), taken.bytes)
+	assert.Equal(t, 0, b.parts[0].bytes)
+}
+
+func TestBatcherMaxAge(t *testing.T) {
+	b := newBatcher(4, 1000, 1<<20, time.Second)
+
+	assert.Empty(t, b.expired(time.Now().Add(time.Hour)), "empty batches never expire")
+
+	m := Msg{1, "tag1", []float64{1}, nil}
+	b.add(2, m, batcherRow(m))
+
+	assert.Empty(t, b.expired(time.Now()))
+	assert.Equal(t, []int{2}, b.expired(time.Now().Add(time.Second)))
+
+	assert.Equal(t, 100*time.Millisecond, b.tick())
+	assert.Equal(t, 10*time.Millisecond, newBatcher(1, 1, 1, 20*time.Millisecond).tick())
+	assert.Equal(t, 5*time.Millisecond, newBatcher(1, 1, 1, 5*time.Millisecond).tick())
+}
+
+func TestWorkerOf(t *testing.T) {
+	seen := make(map[int]bool)
+
+	for i := 0; i < 100; i++ {
+		tag := "tag" + string(rune('a'+i%26))
+		w := workerOf(tag, 4)
+
+		assert.Equal(t, w, workerOf(tag, 4), "tag should always go to the same worker")
+		seen[w] = true
+	}
+
+	assert.True(t, len(seen) > 1, "tags should be spread over workers")
+}
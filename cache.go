@@ -0,0 +1,348 @@
+package main
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// approximate memory of a cache entry without points, and of a point
+// without its values
+const (
+	cacheEntryBytes = 128
+	cachePointBytes = 64
+)
+
+// seriesCache is a `Database`, that caches points of getSeries. pollers of
+// a tag with the same step and alignment sample the same points, so only
+// points, that are still open, or weren't sampled yet, are queried.
+//
+// a point's value depends on rows up to a tier width after it, as a newer
+// row moves its bucket past the point. rows older than `batch.lateWindow`
+// behind their tag's newest one are dropped, so a point is closed, once
+// the tag's newest row hdb has is that far, and a tier width, after it.
+// rows written before that horizon anyway, by catchup or rebalance, or
+// after a restart, are reported by hdb, and drop the tag's entries. values
+// keep the time of the row or bucket they're from, so a point serves
+// series with any lookback, retention's included, and later points, that
+// are queried, only need rows after the last cached one
+type seriesCache struct {
+	Database
+	maxBytes int
+
+	mu    sync.Mutex
+	bytes int
+	// entries, most recently used first
+	lru  *list.List
+	tags map[string]map[seriesKey]*list.Element
+	// hdb watermark, that writes of each cached tag were checked up to
+	seen map[string]int64
+	// count of tags, whose entries were dropped by writes
+	invalidations int
+}
+
+// points of a tag are cached by their source, step and alignment
+type seriesKey struct {
+	tag    string
+	source string
+	step   int64
+	phase  int64
+}
+
+type seriesEntry struct {
+	key    seriesKey
+	points map[int64]pointSample
+	oldest int64
+	bytes  int
+}
+
+// withCache wraps `db` in a seriesCache of `maxBytes`, or returns it, if
+// it's 0
+func withCache(db Database, maxBytes int) Database {
+	if maxBytes == 0 {
+		return db
+	}
+
+	c := &seriesCache{Database: db, maxBytes: maxBytes, lru: list.New(), tags: make(map[string]map[seriesKey]*list.Element), seen: make(map[string]int64)}
+
+	cacheHitRatio.set(func() float64 {
+		hits, misses := float64(cacheHits.get()), float64(cacheMisses.get())
+
+		if hits+misses == 0 {
+			return 0
+		}
+
+		return hits / (hits + misses)
+	})
+
+	cacheBytes.set(func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return float64(c.bytes)
+	})
+
+	return c
+}
+
+func (c *seriesCache) getSeries(tag string, start int64, end int64) (APIResponse, error) {
+	return series(c.Database, tag, start, end, func(t *tier, lo int64, points []int64) ([]pointSample, error) {
+		return c.sample(tag, t, lo, points)
+	})
+}
+
+// sample takes closed points from the cache, and queries the rest after the
+// last cached one before them
+func (c *seriesCache) sample(tag string, t *tier, lo int64, points []int64) ([]pointSample, error) {
+	step := points[1] - points[0]
+
+	if step <= 0 {
+		return c.Database.samplePoints(tag, t, lo, points)
+	}
+
+	key := seriesKey{tag, "raw", step, points[0] % step}
+	width := int64(0)
+
+	if t != nil {
+		key.source, width = t.name, int64(t.width)
+	}
+
+	w, err := c.Database.tagWrites(tag, c.since(tag))
+
+	if err != nil {
+		logger.every("seriesCache.tagWrites", time.Second).warn("can't check writes of a tag, sampling it without the cache", "tag", tag, "error", err)
+		return c.Database.samplePoints(tag, t, lo, points)
+	}
+
+	horizon := w.newest - conf.Batch.LateWindow.Nanoseconds()
+	gen := c.check(tag, w, horizon)
+
+	res, missing := c.cached(key, lo, points)
+
+	cacheHits.add(uint64(len(points) - len(missing)))
+	cacheMisses.add(uint64(len(missing)))
+
+	if len(missing) == 0 {
+		return res, nil
+	}
+
+	queried := make([]int64, len(missing))
+
+	for i, m := range missing {
+		queried[i] = points[m]
+	}
+
+	// values of points without rows after the last cached one are its value
+	first, from := missing[0], lo
+
+	if first > 0 && points[first-1]-width > from {
+		from = points[first-1] - width
+	}
+
+	ps, err := c.Database.samplePoints(tag, t, from, queried)
+
+	if err != nil {
+		return nil, err
+	}
+
+	closed := horizon - width
+
+	var done []pointSample
+
+	for i, m := range missing {
+		res[m] = ps[i]
+
+		if ps[i].empty() && from > lo {
+			res[m] = pointSample{points[m], res[first-1].src, res[first-1].values, res[first-1].typed}
+		}
+
+		if points[m] < closed {
+			done = append(done, res[m])
+		}
+	}
+
+	c.store(key, done, gen, w.at)
+
+	return res, nil
+}
+
+// since is the hdb watermark, that writes of `tag` were checked up to, 0 if
+// it isn't cached
+func (c *seriesCache) since(tag string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seen[tag]
+}
+
+// check drops entries of `tag`, if a row was written before the tag's
+// `horizon` since they were checked, and returns the count of invalidations,
+// so points sampled before a later one aren't stored
+func (c *seriesCache) check(tag string, w tagWrites, horizon int64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byKey, ok := c.tags[tag]
+
+	if !ok {
+		return c.invalidations
+	}
+
+	if w.stale != 0 && w.stale < horizon {
+		for _, el := range byKey {
+			c.evict(el)
+		}
+
+		c.invalidations++
+
+		return c.invalidations
+	}
+
+	if w.at > c.seen[tag] {
+		c.seen[tag] = w.at
+	}
+
+	return c.invalidations
+}
+
+// cached are `points` of `key`, that are cached, as of lookback `lo`, and
+// indexes of ones, that aren't
+func (c *seriesCache) cached(key seriesKey, lo int64, points []int64) ([]pointSample, []int) {
+	res := make([]pointSample, len(points))
+
+	var missing []int
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.tags[key.tag][key]
+
+	if !ok {
+		for i := range points {
+			missing = append(missing, i)
+		}
+
+		return res, missing
+	}
+
+	c.lru.MoveToFront(el)
+
+	e := el.Value.(*seriesEntry)
+
+	for i, p := range points {
+		ps, ok := e.points[p]
+
+		switch {
+		case !ok:
+			missing = append(missing, i)
+		case !ps.empty() && ps.src <= lo:
+			// the value is from before the lookback
+			res[i] = pointSample{p, lo, nil, nil}
+		case ps.empty() && ps.src > lo:
+			// rows between `lo` and the bound it was sampled with weren't looked at
+			missing = append(missing, i)
+		default:
+			res[i] = ps
+		}
+	}
+
+	return res, missing
+}
+
+// store caches closed points of `key`, sampled after writes were checked up
+// to hdb watermark `at`, unless entries were invalidated since, drops ones
+// older than `api.maxLookback`, and evicts least recently used entries over
+// the cap
+func (c *seriesCache) store(key seriesKey, points []pointSample, gen int, at int64) {
+	if len(points) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.invalidations {
+		return
+	}
+
+	byKey, ok := c.tags[key.tag]
+
+	if !ok {
+		byKey = make(map[seriesKey]*list.Element)
+		c.tags[key.tag] = byKey
+		c.seen[key.tag] = at
+	}
+
+	el, ok := byKey[key]
+
+	if !ok {
+		el = c.lru.PushFront(&seriesEntry{key: key, points: make(map[int64]pointSample), oldest: points[0].time})
+		byKey[key] = el
+		c.resize(el.Value.(*seriesEntry), cacheEntryBytes+len(key.tag))
+	}
+
+	e := el.Value.(*seriesEntry)
+
+	for _, ps := range points {
+		if old, ok := e.points[ps.time]; ok {
+			c.resize(e, -pointBytes(old))
+		}
+
+		e.points[ps.time] = ps
+		c.resize(e, pointBytes(ps))
+
+		if ps.time < e.oldest {
+			e.oldest = ps.time
+		}
+	}
+
+	if cutoff := time.Now().Add(-conf.API.MaxLookback).UnixNano(); e.oldest < cutoff {
+		e.oldest = math.MaxInt64
+
+		for p, ps := range e.points {
+			if p < cutoff {
+				delete(e.points, p)
+				c.resize(e, -pointBytes(ps))
+			} else if p < e.oldest {
+				e.oldest = p
+			}
+		}
+	}
+
+	for c.bytes > c.maxBytes && c.lru.Len() > 0 {
+		c.evict(c.lru.Back())
+	}
+}
+
+func (c *seriesCache) evict(el *list.Element) {
+	e := c.lru.Remove(el).(*seriesEntry)
+
+	delete(c.tags[e.key.tag], e.key)
+
+	if len(c.tags[e.key.tag]) == 0 {
+		delete(c.tags, e.key.tag)
+		delete(c.seen, e.key.tag)
+	}
+
+	c.bytes -= e.bytes
+}
+
+func (c *seriesCache) resize(e *seriesEntry, n int) {
+	e.bytes += n
+	c.bytes += n
+}
+
+func pointBytes(ps pointSample) int {
+	n := cachePointBytes + 8*len(ps.values)
+
+	for _, v := range ps.typed {
+		n += 16
+
+		if s, ok := v.(string); ok {
+			n += len(s)
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+// pointsDB samples rows in memory, and records sampled points and their
+// lookback. `newest` and `stale` are reported as the tag's writes
+type pointsDB struct {
+	mockDB
+	rows    Samples
+	newest  int64
+	stale   int64
+	at      int64
+	queried [][]int64
+	los     []int64
+}
+
+func (db *pointsDB) tagWrites(string, int64) (tagWrites, error) {
+	db.at++
+
+	return tagWrites{db.at, db.newest, db.stale}, nil
+}
+
+func (db *pointsDB) samplePoints(tag string, t *tier, lo int64, points []int64) ([]pointSample, error) {
+	db.queried = append(db.queried, points)
+	db.los = append(db.los, lo)
+
+	ps := make([]pointSample, len(points))
+
+	for i, p := range points {
+		ps[i] = pointSample{p, lo, nil, nil}
+
+		n := sort.Search(len(db.rows), func(j int) bool { return db.rows[j].Time > p })
+
+		if n > 0 && db.rows[n-1].Time > lo {
+			ps[i] = pointSample{p, db.rows[n-1].Time, db.rows[n-1].Values, db.rows[n-1].Typed}
+		}
+	}
+
+	return ps, nil
+}
+
+func (db *pointsDB) getSeries(tag string, start int64, end int64) (APIResponse, error) {
+	return series(db, tag, start, end, func(t *tier, lo int64, points []int64) ([]pointSample, error) {
+		return db.samplePoints(tag, t, lo, points)
+	})
+}
+
+// an hour ago, so cached points aren't older than `api.maxLookback`
+func cacheBase() int64 {
+	return bucketOf(time.Now().Add(-time.Hour).UnixNano(), int64(10*time.Second))
+}
+
+func TestSeriesCacheClosedPoints(t *testing.T) {
+	base := cacheBase()
+	sec := int64(time.Second)
+	db := &pointsDB{newest: base + 5*sec + int64(conf.Batch.LateWindow)}
+
+	for i := int64(0); i < 40; i++ {
+		db.rows = append(db.rows, sample{base + i*sec/4, []float64{float64(i)}, nil})
+	}
+
+	c := withCache(db, 1<<20)
+	start, end := base, base+10*sec
+
+	expected, _ := db.getSeries("t", start, end)
+	hits := cacheHits.get()
+
+	res, err := c.getSeries("t", start, end)
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, res)
+	assert.Len(t, db.queried[len(db.queried)-1], 100, "nothing is cached yet")
+
+	res, _ = c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res)
+	assert.Len(t, db.queried[len(db.queried)-1], 51, "points before the watermark should be cached")
+	assert.Equal(t, base+49*sec/10, db.los[len(db.los)-1], "open points need rows after the last cached one")
+	assert.Equal(t, uint64(49), cacheHits.get()-hits)
+	assert.True(t, cacheHitRatio.fn() > 0, "hit ratio should be exposed")
+
+	// rows of open points arrive, and the window moves by a second
+	db.rows = append(db.rows, sample{base + 10*sec, []float64{40}, nil})
+	db.newest += 2 * sec
+	start, end = start+sec, end+sec
+
+	expected, _ = db.getSeries("t", start, end)
+	res, _ = c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res)
+	assert.Len(t, db.queried[len(db.queried)-1], 61, "points before the moved window's start should be served")
+}
+
+func TestSeriesCacheLookback(t *testing.T) {
+	base := cacheBase()
+	sec := int64(time.Second)
+	db := &pointsDB{newest: base + 300*sec + int64(conf.Batch.LateWindow)}
+
+	db.rows = Samples{{base - 10*sec, []float64{1}, nil}, {base + 50*sec, []float64{2}, nil}}
+
+	c := withCache(db, 1<<20)
+
+	// rollup series, looking back a tier width before their start
+	start, end := base-20*sec, base+180*sec
+
+	expected, _ := db.getSeries("t", start, end)
+	res, _ := c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res)
+
+	start, end = base, base+200*sec
+
+	expected, _ = db.getSeries("t", start, end)
+	res, _ = c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res, "values from before the lookback shouldn't be served")
+	assert.Len(t, db.queried[len(db.queried)-1], 10)
+
+	// retention expires rows before base
+	defer func(p *pruner) { retention = p }(retention)
+
+	r := conf.Retention
+	r.Step, r.Default = 10*time.Second, time.Duration(time.Now().UnixNano()-base)
+	retention = newPruner(nil, r, nil)
+
+	start, end = base-20*sec, base+180*sec
+
+	expected, _ = db.getSeries("t", start, end)
+	res, _ = c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res, "values from expired rows shouldn't be served")
+	assert.Equal(t, base-1, db.los[len(db.los)-1], "expired rows shouldn't be looked back to")
+}
+
+func TestSeriesCacheStaleWrites(t *testing.T) {
+	base := cacheBase()
+	sec := int64(time.Second)
+	db := &pointsDB{newest: base + 20*sec + int64(conf.Batch.LateWindow)}
+
+	for i := int64(0); i < 20; i++ {
+		db.rows = append(db.rows, sample{base + i*sec, []float64{float64(i)}, nil})
+	}
+
+	c := withCache(db, 1<<20).(*seriesCache)
+	start, end := base, base+10*sec
+
+	c.getSeries("t", start, end)
+
+	// a late message within the window doesn't change closed points
+	db.stale = db.newest - sec
+	queried := len(db.queried)
+
+	c.getSeries("t", start, end)
+
+	assert.Len(t, db.queried, queried, "closed points should be served")
+
+	// catchup copies a row, that a backend missed, before the horizon
+	db.rows = append(db.rows[:6], append(Samples{{base + 5*sec + sec/2, []float64{100}, nil}}, db.rows[6:]...)...)
+	db.stale = base + 5*sec + sec/2
+
+	expected, _ := db.getSeries("t", start, end)
+	res, _ := c.getSeries("t", start, end)
+
+	assert.Equal(t, expected, res, "points the row changed shouldn't be served")
+	assert.Len(t, db.queried[len(db.queried)-1], 100, "entries of the tag should be dropped")
+	assert.Equal(t, 1, c.invalidations)
+}
+
+func TestTagWrites(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0")
+	store := shards["shard0"].store
+
+	add := func(ts ...int64) {
+		var rows []*kdb.K
+
+		for _, t := range ts {
+			rows = append(rows, kdb.NewList(kdb.Symbol("a"), kdb.Long(t), kdb.Atom(kdb.KF, []float64{1})))
+		}
+
+		store.mu.Lock()
+		store.add(kdb.NewList(rows...))
+		store.mu.Unlock()
+	}
+
+	add(1000, 3000)
+
+	w, err := db.tagWrites("a", 0)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3000), w.newest)
+	assert.Equal(t, int64(0), w.stale)
+
+	add(2000, 4000)
+
+	w, _ = db.tagWrites("a", w.at)
+
+	assert.Equal(t, int64(4000), w.newest)
+	assert.Equal(t, int64(2000), w.stale, "a row older than the newest one should be reported")
+
+	w, _ = db.tagWrites("a", w.at)
+
+	assert.Equal(t, int64(0), w.stale, "writes before `since` shouldn't be reported again")
+}
+
+func TestSeriesCacheEviction(t *testing.T) {
+	base := cacheBase()
+	sec := int64(time.Second)
+	db := &pointsDB{newest: base + 20*sec + int64(conf.Batch.LateWindow)}
+	entry := cacheEntryBytes + 1 + 100*cachePointBytes
+
+	c := withCache(db, 2*entry).(*seriesCache)
+
+	for _, tag := range []string{"a", "b", "c"} {
+		c.getSeries(tag, base, base+10*sec)
+	}
+
+	assert.Equal(t, 2*entry, c.bytes, "the least recently used entry should be evicted")
+	assert.Equal(t, 2, c.lru.Len())
+
+	c.getSeries("a", base, base+10*sec)
+
+	assert.Len(t, db.queried[len(db.queried)-1], 100, "evicted points should be queried")
+	assert.NotContains(t, c.tags, "b")
+
+	_, ok := withCache(db, 0).(*pointsDB)
+
+	assert.True(t, ok, "0 should disable the cache")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+// cluster of instances, sharing `/save`: each tag is owned by one alive
+// member, picked by a hash ring of member addresses, and messages are
+// forwarded to their tag's owner, so a tag is batched by a single instance.
+// members learn about each other by gossip: each `cluster.gossipInterval` a
+// member bumps its heartbeat and exchanges member lists with a random peer.
+// members, whose heartbeat didn't change for `cluster.deadAfter`, are dead,
+// and their tags move to the others
+type cluster struct {
+	self      string
+	secret    []byte
+	scheme    string
+	deadAfter time.Duration
+	client    *fasthttp.Client
+
+	mu        sync.Mutex
+	heartbeat int64
+	members   map[string]*member
+	// sorted addresses of alive members, including self, and their ring
+	alive []string
+	ring  *ring
+}
+
+// member, as seen by this instance
+type member struct {
+	heartbeat int64
+	// when heartbeat last changed, zero for peers never heard from
+	seen time.Time
+}
+
+// newCluster returns nil, with cluster mode disabled, when `c.Self` is empty.
+// peers use https, when `tlsEnabled`
+func newCluster(c clusterConfig, tlsEnabled bool) *cluster {
+	if c.Self == "" {
+		return nil
+	}
+
+	cl := &cluster{
+		self:      c.Self,
+		secret:    []byte(c.Secret),
+		scheme:    "http",
+		deadAfter: c.DeadAfter,
+		client:    &fasthttp.Client{Name: "poc"},
+		members:   make(map[string]*member),
+	}
+
+	if tlsEnabled {
+		cl.scheme = "https"
+	}
+
+	for _, p := range strings.Split(c.Peers, ",") {
+		if p = strings.TrimSpace(p); p != "" && p != c.Self {
+			cl.members[p] = &member{}
+		}
+	}
+
+	cl.update(time.Now())
+
+	clusterMembers.set(func() float64 {
+		cl.mu.Lock()
+		defer cl.mu.Unlock()
+
+		return float64(len(cl.alive))
+	})
+
+	return cl
+}
+
+// owner of stored `tag`, "" when cluster mode is disabled
+func (c *cluster) owner(tag string) string {
+	if c == nil {
+		return ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.alive[c.ring.shard(tag)]
+}
+
+// update rebuilds the ring, if alive members changed. `c.mu` should be held
+// or `c` not shared yet
+func (c *cluster) update(now time.Time) {
+	alive := []string{c.self}
+
+	for addr, m := range c.members {
+		if !m.seen.IsZero() && now.Sub(m.seen) <= c.deadAfter {
+			alive = append(alive, addr)
+		}
+	}
+
+	sort.Strings(alive)
+
+	if strings.Join(alive, ",") == strings.Join(c.alive, ",") {
+		return
+	}
+
+	if c.alive != nil {
+		logger.info("cluster members changed", "self", c.self, "alive", alive, "before", c.alive)
+	}
+
+	c.alive, c.ring = alive, newRing(alive)
+}
+
+// view is member heartbeats as known to this instance, sent on gossip
+func (c *cluster) view() map[string]int64 {
+	v := map[string]int64{c.self: c.heartbeat}
+
+	for addr, m := range c.members {
+		v[addr] = m.heartbeat
+	}
+
+	return v
+}
+
+// merge takes newer heartbeats from a peer's view
+func (c *cluster) merge(view map[string]int64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, hb := range view {
+		if addr == c.self {
+			continue
+		}
+
+		m, ok := c.members[addr]
+
+		if !ok {
+			m = &member{}
+			c.members[addr] = m
+		}
+
+		if hb > m.heartbeat {
+			m.heartbeat, m.seen = hb, now
+		}
+	}
+
+	c.update(now)
+}
+
+// gossip bumps own heartbeat and exchanges views with a random peer, dead
+// ones included, so restarted members are found again
+func (c *cluster) gossip() {
+	c.mu.Lock()
+
+	c.heartbeat++
+
+	var peers []string
+
+	for addr := range c.members {
+		peers = append(peers, addr)
+	}
+
+	body, _ := json.Marshal(c.view())
+
+	c.update(time.Now())
+
+	c.mu.Unlock()
+
+	if len(peers) == 0 {
+		return
+	}
+
+	peer := peers[rand.Intn(len(peers))]
+
+	resp, err := c.post(peer, "/cluster/gossip", body)
+
+	if err != nil {
+		logger.every("cluster.gossip."+peer, c.deadAfter).warn("gossip failed", "peer", peer, "error", err)
+		return
+	}
+
+	var view map[string]int64
+
+	if err := json.Unmarshal(resp, &view); err != nil {
+		logger.every("cluster.gossip."+peer, c.deadAfter).warn("can't decode gossip", "peer", peer, "error", err)
+		return
+	}
+
+	c.merge(view, time.Now())
+}
+
+// run gossips each `interval`. runs forever, meant to be started in a
+// goroutine
+func (c *cluster) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.gossip()
+	}
+}
+
+// post sends `body` to a peer, returns its response body, if it's 200
+func (c *cluster) post(peer string, path string, body []byte) ([]byte, error) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(c.scheme + "://" + peer + path)
+	req.Header.SetMethod("POST")
+	req.Header.Set("X-Cluster-Secret", string(c.secret))
+	req.SetBody(body)
+
+	if err := c.client.DoTimeout(req, resp, c.deadAfter); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("%s responded with %d: %s", peer, resp.StatusCode(), resp.Body())
+	}
+
+	return append([]byte(nil), resp.Body()...), nil
+}
+
+// forward sends a message with stored tag to its owner. ones with typed
+// values or nulls are encoded with encoding/json, see jsonMsg
+func (c *cluster) forward(owner string, m Msg) error {
+	body, _ := easyjson.Marshal(m)
+
+	if m.Typed != nil || hasNaN(m.Values) {
+		body, _ = json.Marshal(jsonMsg(m))
+	}
+
+	_, err := c.post(owner, "/cluster/save", body)
+
+	return err
+}
+
+// handle serves `/cluster/*` requests of peers, authorized by the shared
+// secret instead of API keys:
+// - `POST /cluster/gossip` merges peer's view and responds with own one
+// - `POST /cluster/save` accepts a forwarded message, never forwarding it
+// again, even if the members' views differ
+// - `GET /cluster/members` lists members, their heartbeats and liveness
+func (c *cluster) handle(in *intake, ctx *fasthttp.RequestCtx, path string) {
+	if c == nil {
+		ctx.Error("cluster mode is disabled", fasthttp.StatusNotFound)
+		return
+	}
+
+	if subtle.ConstantTimeCompare(ctx.Request.Header.Peek("X-Cluster-Secret"), c.secret) != 1 {
+		authFailures.inc("cluster")
+		ctx.Error("wrong cluster secret", fasthttp.StatusForbidden)
+		return
+	}
+
+	switch path {
+	case "/cluster/gossip":
+		var view map[string]int64
+
+		if err := json.Unmarshal(ctx.Request.Body(), &view); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		c.merge(view, time.Now())
+
+		c.mu.Lock()
+		resp, _ := json.Marshal(c.view())
+		c.mu.Unlock()
+
+		ctx.Write(resp)
+	case "/cluster/save":
+		m, decoded, err := decodeMsg(ctx.Request.Body())
+
+		if err == nil {
+			_, err = typeValues(&m, ctx.Request.Body(), decoded)
+		}
+
+		if err != nil {
+			msgRejected.inc("decode")
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		if !in.send(m) {
+			msgRejected.inc("shutdown")
+			ctx.Error("shutting down", fasthttp.StatusServiceUnavailable)
+			return
+		}
+
+		ctx.WriteString("OK")
+	case "/cluster/members":
+		type status struct {
+			Heartbeat int64 `json:"heartbeat"`
+			Alive     bool  `json:"alive"`
+		}
+
+		c.mu.Lock()
+
+		members := map[string]status{c.self: {c.heartbeat, true}}
+
+		for addr, m := range c.members {
+			members[addr] = status{m.heartbeat, false}
+		}
+
+		for _, addr := range c.alive {
+			members[addr] = status{members[addr].Heartbeat, true}
+		}
+
+		c.mu.Unlock()
+
+		resp, _ := json.Marshal(members)
+
+		ctx.SetContentType("application/json")
+		ctx.Write(resp)
+	default:
+		ctx.Error("Unsupported path", fasthttp.StatusNotFound)
+	}
+}
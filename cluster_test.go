@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// starts an instance for each of `peers` keys, on in-memory listeners, with
+// `peers` values as their seed lists. returns instances, their msgChans and
+// a client, that reaches them by address
+func getClusterTestServers(t *testing.T, peers map[string]string) (map[string]*cluster, map[string]chan Msg, *fasthttp.Client) {
+	lns := make(map[string]*fasthttputil.InmemoryListener)
+
+	dial := func(addr string) (net.Conn, error) {
+		ln, ok := lns[addr]
+
+		if !ok {
+			return nil, fmt.Errorf("no instance at %s", addr)
+		}
+
+		return ln.Dial()
+	}
+
+	for addr := range peers {
+		lns[addr] = fasthttputil.NewInmemoryListener()
+	}
+
+	cls := make(map[string]*cluster)
+	ins := make(map[string]chan Msg)
+
+	for addr, seeds := range peers {
+		cl := newCluster(clusterConfig{Self: addr, Peers: seeds, Secret: "s3cret", DeadAfter: 200 * time.Millisecond}, false)
+		cl.client = &fasthttp.Client{Dial: dial}
+
+		db := mockDB{}
+		in := db.startQueueConsumer()
+
+		serveMux(lns[addr], db, newIntake(in), nil, nil, cl, nil)
+
+		cls[addr], ins[addr] = cl, in
+	}
+
+	return cls, ins, &fasthttp.Client{Dial: dial}
+}
+
+// gossips until each of `cls` sees `alive` members, or fails after 2s
+func gossipUntil(t *testing.T, cls []*cluster, alive int) {
+	for i := 0; i < 100; i++ {
+		converged := true
+
+		for _, c := range cls {
+			c.gossip()
+
+			c.mu.Lock()
+			converged = converged && len(c.alive) == alive
+			c.mu.Unlock()
+		}
+
+		if converged {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("members didn't converge to %d alive", alive)
+}
+
+func TestClusterGossip(t *testing.T) {
+	cls, _, _ := getClusterTestServers(t, map[string]string{"a:8080": "b:8080", "b:8080": "", "c:8080": "b:8080"})
+
+	a, b, c := cls["a:8080"], cls["b:8080"], cls["c:8080"]
+
+	assert.Equal(t, []string{"a:8080"}, a.alive, "seeds aren't alive until heard from")
+
+	gossipUntil(t, []*cluster{a, b, c}, 3)
+
+	owners := make(map[string]string)
+
+	for i := 0; i < 1000; i++ {
+		tag := fmt.Sprintf("tag%d", i)
+		owners[tag] = a.owner(tag)
+
+		assert.Equal(t, owners[tag], b.owner(tag), "members should agree on owners")
+		assert.Equal(t, owners[tag], c.owner(tag), "members should agree on owners")
+	}
+
+	// c stops gossiping, its heartbeat stops
+	gossipUntil(t, []*cluster{a, b}, 2)
+
+	moved := 0
+
+	for tag, owner := range owners {
+		assert.NotEqual(t, "c:8080", a.owner(tag), "dead member shouldn't own tags")
+		assert.Equal(t, a.owner(tag), b.owner(tag))
+
+		if owner != "c:8080" {
+			assert.Equal(t, owner, a.owner(tag), "only dead member's tags should move")
+		} else {
+			moved++
+		}
+	}
+
+	assert.InDelta(t, 333, moved, 150, "about a third of tags should move")
+}
+
+func TestClusterForward(t *testing.T) {
+	cls, ins, client := getClusterTestServers(t, map[string]string{"a:8080": "b:8080", "b:8080": "a:8080"})
+
+	a, b := cls["a:8080"], cls["b:8080"]
+
+	gossipUntil(t, []*cluster{a, b}, 2)
+
+	tagOf := func(owner string) string {
+		for i := 0; ; i++ {
+			if tag := fmt.Sprintf("tag%d", i); a.owner(tag) == owner {
+				return tag
+			}
+		}
+	}
+
+	for _, owner := range []string{"a:8080", "b:8080"} {
+		tag := tagOf(owner)
+
+		assert.Equal(t, 200, doWithKey(client, "POST", "http://a:8080/save", "", fmt.Sprintf(`{"time":1000,"tag":"%s","values":[1.1]}`, tag)))
+
+		select {
+		case m := <-ins[owner]:
+			assert.Equal(t, tag, m.Tag, "owner should batch the message")
+		case <-time.After(time.Second):
+			t.Fatalf("%s didn't get its tag %s", owner, tag)
+		}
+	}
+
+	assert.Len(t, ins["a:8080"], 0, "messages should be batched once")
+	assert.Len(t, ins["b:8080"], 0, "messages should be batched once")
+
+	func(schemas []schemaConfig) {
+		defer func() { conf.Schemas = schemas }()
+
+		conf.Schemas = []schemaConfig{{Pattern: "tag*", Fields: []string{"count", "state"}, Types: []string{"int", "string"}}}
+
+		assert.Equal(t, 200, doWithKey(client, "POST", "http://a:8080/save", "", fmt.Sprintf(`{"time":1000,"tag":"%s","values":{"state":"on"}}`, tagOf("b:8080"))))
+
+		select {
+		case m := <-ins["b:8080"]:
+			assert.Equal(t, []interface{}{nil, "on"}, m.Typed, "typed values should be forwarded")
+		case <-time.After(time.Second):
+			t.Fatal("typed message wasn't forwarded")
+		}
+	}(conf.Schemas)
+
+	assert.Equal(t, 403, doWithKey(client, "POST", "http://b:8080/cluster/save", "", `{"time":1000,"tag":"x","values":[1.1]}`), "forwards need the secret")
+	assert.Equal(t, 403, doWithKey(client, "GET", "http://b:8080/cluster/members", "", ""))
+
+	// a member, that's alive in gossip, but can't be reached
+	a.merge(map[string]int64{"ghost:8080": 1000}, time.Now())
+
+	tag := tagOf("ghost:8080")
+
+	assert.Equal(t, 200, doWithKey(client, "POST", "http://a:8080/save", "", fmt.Sprintf(`{"time":1000,"tag":"%s","values":[1.1]}`, tag)), "messages shouldn't be lost, when the owner is down")
+	assert.Equal(t, tag, (<-ins["a:8080"]).Tag, "message should be kept by the instance, that received it")
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v2"
+)
+
+// Config holds all server settings. defaults are overridden, in this order,
+// by a YAML file(`-config` flag or CONFIG env), env variables and flags
+type Config struct {
+	Addr            string            `yaml:"addr"`
+	TP              kdbAddr           `yaml:"tp"`
+	HDB             kdbAddr           `yaml:"hdb"`
+	Replica         replicaConfig     `yaml:"replica"`
+	Shards          []shardConfig     `yaml:"shards"`
+	Replication     replicationConfig `yaml:"replication"`
+	Queue           queueConfig       `yaml:"queue"`
+	Batch           batchConfig       `yaml:"batch"`
+	API             apiConfig         `yaml:"api"`
+	Health          healthConfig      `yaml:"health"`
+	TLS             tlsConfig         `yaml:"tls"`
+	Auth            authConfig        `yaml:"auth"`
+	RateLimit       rateLimitConfig   `yaml:"rateLimit"`
+	Tenants         []tenantConfig    `yaml:"tenants"`
+	Retention       retentionConfig   `yaml:"retention"`
+	Schemas         []schemaConfig    `yaml:"schemas"`
+	Cluster         clusterConfig     `yaml:"cluster"`
+	ShutdownTimeout time.Duration     `yaml:"shutdownTimeout"`
+	Log             logConfig         `yaml:"log"`
+}
+
+type kdbAddr struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+}
+
+// tp and hdb pair, that stores a share of tags. `Name` places the shard on
+// the hash ring, so it shouldn't change once the shard has data
+type shardConfig struct {
+	Name    string        `yaml:"name"`
+	TP      kdbAddr       `yaml:"tp"`
+	HDB     kdbAddr       `yaml:"hdb"`
+	Replica replicaConfig `yaml:"replica"`
+}
+
+// independent tp and hdb pair, that gets every batch of the shard too.
+// replication is disabled when `TP.Host` is empty
+type replicaConfig struct {
+	TP  kdbAddr `yaml:"tp"`
+	HDB kdbAddr `yaml:"hdb"`
+}
+
+type replicationConfig struct {
+	// a batch is done once it's accepted by one(primary or replica tp) or both
+	Ack string `yaml:"ack"`
+	// JSON lines file of rows, that a backend missed with ack one
+	GapLog string `yaml:"gapLog"`
+	// longest `.P.tp_save` call, before it's failed
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type queueConfig struct {
+	// msgChan size
+	Messages int `yaml:"messages"`
+	// db.out size of each worker, in batches
+	Batches int `yaml:"batches"`
+}
+
+type batchConfig struct {
+	// parallel `saveBatch` workers, each with its own tp connection
+	Workers int `yaml:"workers"`
+	// a batch is flushed once it reaches any of these
+	MaxRows  int           `yaml:"maxRows"`
+	MaxBytes int           `yaml:"maxBytes"`
+	MaxAge   time.Duration `yaml:"maxAge"`
+	// messages older than this, relative to the newest one of the tag, are dropped
+	LateWindow time.Duration `yaml:"lateWindow"`
+}
+
+type apiConfig struct {
+	// oldest allowed `start`, relative to now
+	MaxLookback time.Duration `yaml:"maxLookback"`
+	// queries slower than this are logged
+	SlowQuery time.Duration `yaml:"slowQuery"`
+	// longest `/api` wait for `waitFor`, and its default `timeout`
+	MaxWait time.Duration `yaml:"maxWait"`
+	// memory of the series cache, 0 disables it
+	CacheBytes int `yaml:"cacheBytes"`
+}
+
+type healthConfig struct {
+	// share of a full queue, at which the service isn't ready
+	QueueSaturation float64 `yaml:"queueSaturation"`
+	// time without a successful flush with batches waiting, at which the service isn't ready
+	FlushStale time.Duration `yaml:"flushStale"`
+}
+
+type tlsConfig struct {
+	// certificate and key files, TLS is disabled when empty
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"minVersion"`
+	// TLS 1.2 cipher policy: modern(ECDHE with AEAD only) or default
+	Ciphers string `yaml:"ciphers"`
+	// CA to verify client certificates, for `clientAuth` optional or require
+	ClientCAFile string `yaml:"clientCAFile"`
+	// none, optional or require
+	ClientAuth string `yaml:"clientAuth"`
+	// how often the files are checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+type authConfig struct {
+	// YAML file with API keys, auth is disabled when empty
+	KeysFile string `yaml:"keysFile"`
+	// how often the keys file is checked for changes
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+}
+
+// token bucket of `Rate` per second, holding `Burst` tokens. 0 rate is
+// unlimited
+type rateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// limits of a route, by API key(or client certificate) name, client IP and tag
+type routeLimits struct {
+	Key rateLimit `yaml:"key"`
+	IP  rateLimit `yaml:"ip"`
+	Tag rateLimit `yaml:"tag"`
+}
+
+type rateLimitConfig struct {
+	Save routeLimits `yaml:"save"`
+	API  routeLimits `yaml:"api"`
+	// how often full buckets are dropped
+	SweepInterval time.Duration `yaml:"sweepInterval"`
+}
+
+// tenant and its quotas, 0 is unlimited. tenants are only set in the YAML
+// file
+type tenantConfig struct {
+	Name string `yaml:"name"`
+	// distinct tags the tenant can write
+	MaxTags int `yaml:"maxTags"`
+	// messages per second, up to `Burst` at once
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// messages older than this are dropped, and can't be queried
+	Retention time.Duration `yaml:"retention"`
+}
+
+type retentionConfig struct {
+	// retention of tags without a matching rule or tenant retention, 0
+	// keeps them forever
+	Default time.Duration `yaml:"default"`
+	// the first rule matching a stored tag wins, over tenant retention.
+	// rules are only set in the YAML file
+	Rules []retentionRule `yaml:"rules"`
+	// how often expired rows are pruned
+	Interval time.Duration `yaml:"interval"`
+	// cutoffs move in steps of this, so reads skip expired rows, that are
+	// still on disk, in steps too. rows are dropped per date partition
+	Step time.Duration `yaml:"step"`
+}
+
+// schema names value indexes of tags matching `Pattern`, the first matching
+// one wins. schemas are only set in the YAML file
+type schemaConfig struct {
+	// `path.Match` pattern of stored tags, e.g. `sensor.*` or `acme:*`
+	Pattern string   `yaml:"pattern"`
+	Fields  []string `yaml:"fields"`
+	// value types of fields: float, int, bool or string. one type for all
+	// of them, or one per field, float without it
+	Types []string `yaml:"types"`
+}
+
+type retentionRule struct {
+	// `path.Match` pattern of stored tags, e.g. `debug.*` or `acme:*`
+	Pattern string        `yaml:"pattern"`
+	Keep    time.Duration `yaml:"keep"`
+}
+
+type clusterConfig struct {
+	// address of this instance, as its peers reach it. cluster mode is
+	// disabled when empty
+	Self string `yaml:"self"`
+	// comma separated addresses of other instances to start gossip with,
+	// the rest are learned from them
+	Peers string `yaml:"peers"`
+	// shared by all instances, authorizes forwarded messages and gossip
+	Secret string `yaml:"secret"`
+	// how often member lists are exchanged with a random peer
+	GossipInterval time.Duration `yaml:"gossipInterval"`
+	// a member without new heartbeats this long is dead, and its tags move
+	DeadAfter time.Duration `yaml:"deadAfter"`
+}
+
+type logConfig struct {
+	Level string `yaml:"level"`
+}
+
+// resolved server config, set once in `main` before anything is started
+var conf = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Addr:            ":8080",
+		TP:              kdbAddr{"127.0.0.1", 6012},
+		HDB:             kdbAddr{"127.0.0.1", 6013},
+		Shards:          []shardConfig{},
+		Replication:     replicationConfig{Ack: "both", GapLog: "replication-gaps.jsonl", Timeout: 10 * time.Second},
+		Queue:           queueConfig{Messages: 100000, Batches: 5},
+		Batch:           batchConfig{Workers: 4, MaxRows: 50000, MaxBytes: 8 << 20, MaxAge: time.Second, LateWindow: time.Minute},
+		API:             apiConfig{MaxLookback: 24 * time.Hour, SlowQuery: 80 * time.Millisecond, MaxWait: 10 * time.Second, CacheBytes: 64 << 20},
+		Health:          healthConfig{QueueSaturation: 0.9, FlushStale: 10 * time.Second},
+		TLS:             tlsConfig{MinVersion: "1.2", Ciphers: "modern", ClientAuth: "none", ReloadInterval: 10 * time.Second},
+		Auth:            authConfig{ReloadInterval: 10 * time.Second},
+		RateLimit:       rateLimitConfig{SweepInterval: time.Minute},
+		Tenants:         []tenantConfig{},
+		Retention:       retentionConfig{Rules: []retentionRule{}, Interval: 10 * time.Minute, Step: time.Hour},
+		Schemas:         []schemaConfig{},
+		Cluster:         clusterConfig{GossipInterval: time.Second, DeadAfter: 5 * time.Second},
+		ShutdownTimeout: 10 * time.Second,
+		Log:             logConfig{Level: "info"},
+	}
+}
+
+// shards, or a single "shard0" of `tp` and `hdb`, when there are none
+func (c Config) shards() []shardConfig {
+	if len(c.Shards) > 0 {
+		return c.Shards
+	}
+
+	return []shardConfig{{"shard0", c.TP, c.HDB, c.Replica}}
+}
+
+// setting binds a config field to its flag and env variable names
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value interface{}
+	// redacted in logs and `/admin/config`
+	secret bool
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"addr", "ADDR", "HTTP listen address", &c.Addr, false},
+		{"tp.host", "TP_HOST", "tp host", &c.TP.Host, false},
+		{"tp.port", "TP_PORT", "tp port", &c.TP.Port, false},
+		{"hdb.host", "HDB_HOST", "hdb host", &c.HDB.Host, false},
+		{"hdb.port", "HDB_PORT", "hdb port", &c.HDB.Port, false},
+		{"replica.tp.host", "REPLICA_TP_HOST", "replica tp host, replication is disabled when empty", &c.Replica.TP.Host, false},
+		{"replica.tp.port", "REPLICA_TP_PORT", "replica tp port", &c.Replica.TP.Port, false},
+		{"replica.hdb.host", "REPLICA_HDB_HOST", "replica hdb host", &c.Replica.HDB.Host, false},
+		{"replica.hdb.port", "REPLICA_HDB_PORT", "replica hdb port", &c.Replica.HDB.Port, false},
+		{"replication.ack", "REPLICATION_ACK", "a batch is done once accepted by one tp or both", &c.Replication.Ack, false},
+		{"replication.gapLog", "REPLICATION_GAP_LOG", "file of rows a backend missed with ack one", &c.Replication.GapLog, false},
+		{"replication.timeout", "REPLICATION_TIMEOUT", "longest tp_save call, before it's failed", &c.Replication.Timeout, false},
+		{"queue.messages", "QUEUE_MESSAGES", "msgChan size", &c.Queue.Messages, false},
+		{"queue.batches", "QUEUE_BATCHES", "db.out size of each worker, in batches", &c.Queue.Batches, false},
+		{"batch.workers", "BATCH_WORKERS", "parallel saveBatch workers", &c.Batch.Workers, false},
+		{"batch.maxRows", "BATCH_MAX_ROWS", "flush a batch at this many rows", &c.Batch.MaxRows, false},
+		{"batch.maxBytes", "BATCH_MAX_BYTES", "flush a batch at this size", &c.Batch.MaxBytes, false},
+		{"batch.maxAge", "BATCH_MAX_AGE", "flush a batch at this age", &c.Batch.MaxAge, false},
+		{"batch.lateWindow", "LATE_WINDOW", "drop messages this late for their tag", &c.Batch.LateWindow, false},
+		{"api.maxLookback", "MAX_LOOKBACK", "oldest allowed /api start, relative to now", &c.API.MaxLookback, false},
+		{"api.slowQuery", "SLOW_QUERY", "log /api queries slower than this", &c.API.SlowQuery, false},
+		{"api.maxWait", "MAX_WAIT", "longest /api wait for waitFor, and its default timeout", &c.API.MaxWait, false},
+		{"api.cacheBytes", "CACHE_BYTES", "memory of the /api series cache, 0 disables it", &c.API.CacheBytes, false},
+		{"health.queueSaturation", "QUEUE_SATURATION", "share of a full queue, at which the service isn't ready", &c.Health.QueueSaturation, false},
+		{"health.flushStale", "FLUSH_STALE", "time without a flush, at which the service isn't ready", &c.Health.FlushStale, false},
+		{"tls.certFile", "TLS_CERT_FILE", "TLS certificate file, TLS is disabled when empty", &c.TLS.CertFile, false},
+		{"tls.keyFile", "TLS_KEY_FILE", "TLS key file", &c.TLS.KeyFile, false},
+		{"tls.minVersion", "TLS_MIN_VERSION", "minimal TLS version: 1.0, 1.1, 1.2 or 1.3", &c.TLS.MinVersion, false},
+		{"tls.ciphers", "TLS_CIPHERS", "TLS 1.2 cipher policy: modern or default", &c.TLS.Ciphers, false},
+		{"tls.clientCAFile", "TLS_CLIENT_CA_FILE", "CA file to verify client certificates", &c.TLS.ClientCAFile, false},
+		{"tls.clientAuth", "TLS_CLIENT_AUTH", "client certificates: none, optional or require", &c.TLS.ClientAuth, false},
+		{"tls.reloadInterval", "TLS_RELOAD_INTERVAL", "how often TLS files are checked for changes", &c.TLS.ReloadInterval, false},
+		{"auth.keysFile", "AUTH_KEYS_FILE", "YAML file with API keys, auth is disabled when empty", &c.Auth.KeysFile, false},
+		{"auth.reloadInterval", "AUTH_RELOAD_INTERVAL", "how often the keys file is checked for changes", &c.Auth.ReloadInterval, false},
+		{"rateLimit.save.key.rate", "RATE_SAVE_KEY", "/save requests per second per API key, 0 is unlimited", &c.RateLimit.Save.Key.Rate, false},
+		{"rateLimit.save.key.burst", "RATE_SAVE_KEY_BURST", "/save burst per API key", &c.RateLimit.Save.Key.Burst, false},
+		{"rateLimit.save.ip.rate", "RATE_SAVE_IP", "/save requests per second per client IP, 0 is unlimited", &c.RateLimit.Save.IP.Rate, false},
+		{"rateLimit.save.ip.burst", "RATE_SAVE_IP_BURST", "/save burst per client IP", &c.RateLimit.Save.IP.Burst, false},
+		{"rateLimit.save.tag.rate", "RATE_SAVE_TAG", "/save messages per second per tag, 0 is unlimited", &c.RateLimit.Save.Tag.Rate, false},
+		{"rateLimit.save.tag.burst", "RATE_SAVE_TAG_BURST", "/save burst per tag", &c.RateLimit.Save.Tag.Burst, false},
+		{"rateLimit.api.key.rate", "RATE_API_KEY", "/api requests per second per API key, 0 is unlimited", &c.RateLimit.API.Key.Rate, false},
+		{"rateLimit.api.key.burst", "RATE_API_KEY_BURST", "/api burst per API key", &c.RateLimit.API.Key.Burst, false},
+		{"rateLimit.api.ip.rate", "RATE_API_IP", "/api requests per second per client IP, 0 is unlimited", &c.RateLimit.API.IP.Rate, false},
+		{"rateLimit.api.ip.burst", "RATE_API_IP_BURST", "/api burst per client IP", &c.RateLimit.API.IP.Burst, false},
+		{"rateLimit.api.tag.rate", "RATE_API_TAG", "/api requests per second per tag, 0 is unlimited", &c.RateLimit.API.Tag.Rate, false},
+		{"rateLimit.api.tag.burst", "RATE_API_TAG_BURST", "/api burst per tag", &c.RateLimit.API.Tag.Burst, false},
+		{"rateLimit.sweepInterval", "RATE_SWEEP_INTERVAL", "how often full rate limit buckets are dropped", &c.RateLimit.SweepInterval, false},
+		{"retention.default", "RETENTION_DEFAULT", "retention of tags without a rule or tenant retention, 0 keeps them forever", &c.Retention.Default, false},
+		{"retention.interval", "RETENTION_INTERVAL", "how often expired rows are pruned", &c.Retention.Interval, false},
+		{"retention.step", "RETENTION_STEP", "retention cutoffs move in steps of this", &c.Retention.Step, false},
+		{"cluster.self", "CLUSTER_SELF", "address peers reach this instance at, cluster mode is disabled when empty", &c.Cluster.Self, false},
+		{"cluster.peers", "CLUSTER_PEERS", "comma separated addresses of other instances", &c.Cluster.Peers, false},
+		{"cluster.secret", "CLUSTER_SECRET", "secret shared by cluster instances", &c.Cluster.Secret, true},
+		{"cluster.gossipInterval", "CLUSTER_GOSSIP_INTERVAL", "how often member lists are exchanged", &c.Cluster.GossipInterval, false},
+		{"cluster.deadAfter", "CLUSTER_DEAD_AFTER", "a member without heartbeats this long is dead", &c.Cluster.DeadAfter, false},
+		{"shutdownTimeout", "SHUTDOWN_TIMEOUT", "time to wait for pending batches on shutdown", &c.ShutdownTimeout, false},
+		{"log.level", "LOG_LEVEL", "log level: debug, info, warn or error", &c.Log.Level, false},
+	}
+}
+
+// loadConfig resolves config from defaults, YAML file, env and `args` flags
+func loadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("poc", flag.ContinueOnError)
+
+	path := fs.String("config", os.Getenv("CONFIG"), "YAML config file")
+
+	// flags are parsed as strings first, and applied after the file and env
+	flags := make(map[string]*string)
+
+	for _, s := range c.settings() {
+		flags[s.flag] = fs.String(s.flag, "", fmt.Sprintf("%s (env %s, default %v)", s.usage, s.env, s.get()))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		data, err := ioutil.ReadFile(*path)
+
+		if err != nil {
+			return c, err
+		}
+
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("can't parse %s: %v", *path, err)
+		}
+	}
+
+	for _, s := range c.settings() {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(v); err != nil {
+				return c, fmt.Errorf("env %s: %v", s.env, err)
+			}
+		}
+	}
+
+	var err error
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range c.settings() {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(*flags[s.flag]); e != nil {
+					err = fmt.Errorf("flag -%s: %v", s.flag, e)
+				}
+			}
+		}
+	})
+
+	if err != nil {
+		return c, err
+	}
+
+	return c, c.validate()
+}
+
+func (s setting) get() interface{} {
+	switch v := s.value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return *v
+	case *float64:
+		return *v
+	case *time.Duration:
+		return *v
+	}
+
+	return nil
+}
+
+func (s setting) set(str string) (err error) {
+	switch v := s.value.(type) {
+	case *string:
+		*v = str
+	case *int:
+		*v, err = strconv.Atoi(str)
+	case *float64:
+		*v, err = strconv.ParseFloat(str, 64)
+	case *time.Duration:
+		*v, err = time.ParseDuration(str)
+	default:
+		err = fmt.Errorf("unsupported setting type %T", v)
+	}
+
+	return err
+}
+
+func (c Config) validate() error {
+	var errs []string
+
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.Addr != "", "addr is empty")
+
+	addrs := map[string]kdbAddr{"tp": c.TP, "hdb": c.HDB}
+	shards := make(map[string]bool)
+
+	if c.Replica.TP.Host != "" {
+		addrs["replica.tp"] = c.Replica.TP
+		addrs["replica.hdb"] = c.Replica.HDB
+	}
+
+	for _, s := range c.Shards {
+		check(s.Name != "", "shard name is empty")
+		check(!shards[s.Name], "shard %q is duplicated", s.Name)
+
+		addrs["shards."+s.Name+".tp"] = s.TP
+		addrs["shards."+s.Name+".hdb"] = s.HDB
+		shards[s.Name] = true
+
+		if s.Replica.TP.Host != "" {
+			addrs["shards."+s.Name+".replica.tp"] = s.Replica.TP
+			addrs["shards."+s.Name+".replica.hdb"] = s.Replica.HDB
+		}
+	}
+
+	replicas := 0
+
+	for _, s := range c.shards() {
+		if s.Replica.TP.Host != "" {
+			replicas++
+			check(s.Replica.TP != s.TP && s.Replica.HDB != s.HDB, "shard %q replica should be a different tp and hdb", s.Name)
+		}
+	}
+
+	check(c.Replication.Ack == "one" || c.Replication.Ack == "both", "replication.ack %q should be one or both", c.Replication.Ack)
+	check(c.Replication.Timeout > 0, "replication.timeout should be positive")
+	check(replicas == 0 || c.Replication.Ack == "both" || c.Replication.GapLog != "", "replication.ack one needs replication.gapLog")
+
+	for name, a := range addrs {
+		check(a.Host != "", "%s.host is empty", name)
+		check(a.Port > 0 && a.Port < 65536, "%s.port %d is out of range", name, a.Port)
+	}
+
+	check(c.Queue.Messages > 0, "queue.messages should be positive")
+	check(c.Queue.Batches > 0, "queue.batches should be positive")
+	check(c.Batch.Workers > 0, "batch.workers should be positive")
+	check(c.Batch.MaxRows > 0, "batch.maxRows should be positive")
+	check(c.Batch.MaxBytes > 0, "batch.maxBytes should be positive")
+	check(c.Batch.MaxAge > 0, "batch.maxAge should be positive")
+	check(c.Batch.LateWindow >= 0, "batch.lateWindow should not be negative")
+	check(c.API.MaxLookback > 0, "api.maxLookback should be positive")
+	check(c.API.MaxWait > 0, "api.maxWait should be positive")
+	check(c.API.CacheBytes >= 0, "api.cacheBytes should not be negative")
+	check(c.Health.QueueSaturation > 0 && c.Health.QueueSaturation <= 1, "health.queueSaturation should be in (0, 1]")
+	check(c.Health.FlushStale > 0, "health.flushStale should be positive")
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.certFile and tls.keyFile should be set together")
+	check(tlsVersions[c.TLS.MinVersion] != 0, "tls.minVersion %q should be one of 1.0, 1.1, 1.2 or 1.3", c.TLS.MinVersion)
+	_, ok := tlsCiphers[c.TLS.Ciphers]
+	check(ok, "tls.ciphers %q should be modern or default", c.TLS.Ciphers)
+	_, ok = tlsClientAuth[c.TLS.ClientAuth]
+	check(ok, "tls.clientAuth %q should be none, optional or require", c.TLS.ClientAuth)
+	check(c.TLS.ClientAuth == "none" || c.TLS.ClientCAFile != "", "tls.clientAuth %s needs tls.clientCAFile", c.TLS.ClientAuth)
+	check(c.TLS.ClientAuth == "none" || c.TLS.CertFile != "", "tls.clientAuth %s needs tls.certFile", c.TLS.ClientAuth)
+	check(c.TLS.ReloadInterval > 0, "tls.reloadInterval should be positive")
+	check(c.Auth.ReloadInterval > 0, "auth.reloadInterval should be positive")
+	for route, l := range map[string]routeLimits{"save": c.RateLimit.Save, "api": c.RateLimit.API} {
+		for kind, r := range map[string]rateLimit{"key": l.Key, "ip": l.IP, "tag": l.Tag} {
+			check(r.Rate >= 0, "rateLimit.%s.%s.rate should not be negative", route, kind)
+			check(r.Rate == 0 || r.Burst > 0, "rateLimit.%s.%s.burst should be positive", route, kind)
+		}
+	}
+
+	seen := make(map[string]bool)
+
+	for _, t := range c.Tenants {
+		check(tenantName.MatchString(t.Name), "tenant name %q should match %s", t.Name, tenantName)
+		check(!seen[t.Name], "tenant %q is duplicated", t.Name)
+		check(t.MaxTags >= 0 && t.Rate >= 0 && t.Retention >= 0, "tenant %q quotas should not be negative", t.Name)
+		check(t.Rate == 0 || t.Burst > 0, "tenant %q burst should be positive", t.Name)
+
+		seen[t.Name] = true
+	}
+
+	check(c.Retention.Default >= 0, "retention.default should not be negative")
+	check(c.Retention.Interval > 0, "retention.interval should be positive")
+	check(c.Retention.Step > 0, "retention.step should be positive")
+
+	for _, rule := range c.Retention.Rules {
+		_, err := path.Match(rule.Pattern, "")
+		check(rule.Pattern != "" && err == nil, "retention rule pattern %q is invalid", rule.Pattern)
+		check(rule.Keep > 0, "retention rule %q keep should be positive", rule.Pattern)
+	}
+
+	for _, schema := range c.Schemas {
+		_, err := path.Match(schema.Pattern, "")
+		check(schema.Pattern != "" && err == nil, "schema pattern %q is invalid", schema.Pattern)
+		check(len(schema.Fields) > 0, "schema %q should have fields", schema.Pattern)
+
+		names := make(map[string]bool)
+
+		for _, f := range schema.Fields {
+			_, err := strconv.Atoi(f)
+			check(f != "" && err != nil && !strings.Contains(f, ","), "schema %q field %q should be a name, not a number, without commas", schema.Pattern, f)
+			check(!names[f], "schema %q field %q is duplicated", schema.Pattern, f)
+
+			names[f] = true
+		}
+
+		check(len(schema.Types) <= 1 || len(schema.Types) == len(schema.Fields), "schema %q should have one type, or one per field", schema.Pattern)
+
+		for _, t := range schema.Types {
+			check(valueTypes[t], "schema %q type %q should be float, int, bool or string", schema.Pattern, t)
+		}
+	}
+
+	check(c.Cluster.Self == "" || c.Cluster.Secret != "", "cluster.self needs cluster.secret")
+	check(c.Cluster.Self == "" || c.TLS.ClientAuth != "require", "cluster.self needs tls.clientAuth none or optional, peers don't present certificates")
+	check(c.Cluster.GossipInterval > 0, "cluster.gossipInterval should be positive")
+	check(c.Cluster.DeadAfter > c.Cluster.GossipInterval, "cluster.deadAfter should be longer than cluster.gossipInterval")
+	check(c.RateLimit.SweepInterval > 0, "rateLimit.sweepInterval should be positive")
+	check(c.ShutdownTimeout > 0, "shutdownTimeout should be positive")
+
+	_, err := parseLevel(c.Log.Level)
+	check(err == nil, "log.level: %v", err)
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + fmt.Sprint(errs))
+	}
+
+	return nil
+}
+
+// flat `flag: value` view of the config, for logging
+func (c *Config) flat() map[string]string {
+	m := make(map[string]string)
+
+	for _, s := range c.redacted().settings() {
+		m[s.flag] = fmt.Sprint(s.get())
+	}
+
+	return m
+}
+
+// redacted copy of the config, with values of secret settings replaced
+func (c *Config) redacted() *Config {
+	r := *c
+
+	for _, s := range r.settings() {
+		if s.secret && s.get() != "" {
+			s.set("<redacted>")
+		}
+	}
+
+	return &r
+}
+
+// `GET /admin/config` returns resolved config as YAML
+func configHandler(ctx *fasthttp.RequestCtx) {
+	if !ctx.IsGet() {
+		ctx.Error("config is read-only", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := yaml.Marshal(conf.redacted())
+
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/x-yaml")
+	ctx.Write(data)
+}
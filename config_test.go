@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	f, err := ioutil.TempFile("", "poc-config")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(f.Name())
+
+	f.WriteString("addr: :9090\ntp:\n  host: tp.local\n  port: 7012\nbatch:\n  maxAge: 500ms\n")
+	f.Close()
+
+	os.Setenv("TP_PORT", "8012")
+	defer os.Unsetenv("TP_PORT")
+
+	c, err := loadConfig([]string{"-config", f.Name(), "-addr", ":7070"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, ":7070", c.Addr, "flag should override file")
+	assert.Equal(t, "tp.local", c.TP.Host, "file should override default")
+	assert.Equal(t, 8012, c.TP.Port, "env should override file")
+	assert.Equal(t, 500*time.Millisecond, c.Batch.MaxAge, "durations should be parsed")
+	assert.Equal(t, 6013, c.HDB.Port, "should keep defaults")
+}
+
+func TestConfigValidation(t *testing.T) {
+	_, err := loadConfig([]string{"-tp.port", "0", "-log.level", "loud"})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tp.port 0 is out of range")
+	assert.Contains(t, err.Error(), "log.level")
+
+	_, err = loadConfig([]string{"-batch.maxAge", "soon"})
+
+	assert.Error(t, err, "should fail on unparsable flag values")
+}
+
+func TestConfigAdmin(t *testing.T) {
+	t.Parallel()
+
+	ts := getMockTestServer()
+
+	code, body, _ := ts.c.Get(nil, "http://test.me/admin/config")
+
+	assert.Equal(t, 200, code, "should get a 200")
+	assert.Contains(t, string(body), "maxAge: 1s")
+
+	code, _, _ = ts.c.Post(nil, "http://test.me/admin/config", nil)
+
+	assert.Equal(t, 405, code, "config should be read-only")
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := defaultConfig()
+	c.Cluster.Secret = "s3cret"
+
+	data, _ := yaml.Marshal(c.redacted())
+
+	assert.Equal(t, "<redacted>", c.flat()["cluster.secret"], "secrets shouldn't be logged")
+	assert.NotContains(t, string(data), "s3cret", "secrets shouldn't be served")
+	assert.Contains(t, string(data), "secret: <redacted>")
+	assert.Equal(t, "s3cret", c.Cluster.Secret, "the config itself should keep the secret")
+	c.Cluster.Secret = ""
+
+	assert.Equal(t, "", c.redacted().Cluster.Secret, "empty secrets show they're unset")
+}
+
+func TestConfigExample(t *testing.T) {
+	c, err := loadConfig([]string{"-config", "poc.yml"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultConfig(), c, "poc.yml should list defaults")
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 // change here to switch `Database` implementation, that code uses
 // see 'getDB' below for candidates
 const dbVendor = "kdb"
@@ -7,10 +9,19 @@ const dbVendor = "kdb"
 // Database provides
 type Database interface {
 	getSeries(tag string, start int64, end int64) (APIResponse, error)
+	visibleUntil(tag string) (int64, error)
+	waitVisible(tag string, waitFor int64, timeout time.Duration)
+	samplePoints(tag string, t *tier, lo int64, points []int64) ([]pointSample, error)
+	tagWrites(tag string, since int64) (tagWrites, error)
 	getIntervalSample(tag string, start int64, end int64) (sample, error)
-	saveBatch()
+	getTags() ([]string, error)
+	exportSeries(tag string, start int64, end int64) (Samples, error)
+	prune(cutoff func(tag string) int64) (int, int, error)
+	saveBatch(worker int)
 	startQueueConsumer() chan Msg
 	query(string) error
+	health() map[string]healthStatus
+	stop(timeout time.Duration) int
 }
 
 // currently implemented options are 'kdb' and 'clickhouse'
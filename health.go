@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+// healthStatus of a single component in `/health/ready` response
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Info   map[string]interface{} `json:"info,omitempty"`
+}
+
+// readiness is the `/health/ready` response, `Status` is "ok" only when
+// all of the components are
+type readiness struct {
+	Status     string                  `json:"status"`
+	Components map[string]healthStatus `json:"components"`
+}
+
+// statusOf builds "ok" or "fail" status from `err`, with `kv` pairs as info
+func statusOf(err error, kv ...interface{}) healthStatus {
+	hs := healthStatus{Status: statusOK}
+
+	if err != nil {
+		hs.Status = statusFail
+		hs.Error = err.Error()
+	}
+
+	if len(kv) > 0 {
+		hs.Info = make(map[string]interface{}, len(kv)/2)
+	}
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		k, _ := kv[i].(string)
+
+		switch v := kv[i+1].(type) {
+		case time.Duration:
+			hs.Info[k] = v.String()
+		default:
+			hs.Info[k] = v
+		}
+	}
+
+	return hs
+}
+
+// `/health/live`: the process is up and serving requests
+func liveHandler(ctx *fasthttp.RequestCtx) {
+	ctx.WriteString("OK")
+}
+
+// `/health/ready`: backends are reachable, queues aren't saturated and
+// batches are being flushed. responds with 503 if any of them fails
+func readyHandler(db Database, ctx *fasthttp.RequestCtx) {
+	r := readiness{Status: statusOK, Components: db.health()}
+
+	for _, c := range r.Components {
+		if c.Status != statusOK {
+			r.Status = statusFail
+		}
+	}
+
+	if r.Status != statusOK {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+
+	respJS, _ := json.Marshal(r)
+
+	ctx.SetContentType("application/json")
+	ctx.Write(respJS)
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
-	"reflect"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
 )
 
 func addMessagesInterval(start int64, end int64, amt int64, tags int, msgs chan Msg) {
@@ -24,82 +27,109 @@ func addMessagesInterval(start int64, end int64, amt int64, tags int, msgs chan
 }
 
 func TestPopulateOneTag24h(t *testing.T) {
-	t.Skip("too slow atm")
-	period := 24 * time.Hour
-	amount := int64(86400)
-	interval := period.Nanoseconds() / 100
-
-	// now := time.Now()
-	var start int64 = 1000000000000000000
-	end := start + period.Nanoseconds()
-	tag := "t0"
+	period := 23 * time.Hour
+	amount := int64(period / time.Second)
 
-	td := getTestServer()
+	end := time.Now().UnixNano()
+	start := end - period.Nanoseconds()
+	tag := "t0"
 
-	fmt.Printf("> messages %d\n", len(td.in))
+	td := getTestServer(t)
 
 	addMessagesInterval(start, end, amount, 1, td.in)
 
-	// wait for send chan to be done
-	for len(td.in) > 0 {
-		fmt.Printf("> still in db.in: %d\n", len(td.in))
-		time.Sleep(100 * time.Millisecond)
+	td.shard.store.waitRows(t, int(amount))
+
+	// buckets are 828s wide, read from r1m rollups: a point has the newest
+	// row of the last bucket, that has all of its rows before the point
+	res := td.getData(t, start, end, tag)
+	step := period.Nanoseconds() / 100
+	width := int64(time.Minute)
+
+	assert.Len(t, res.Samples, 100)
+
+	for i, s := range res.Samples {
+		p := start + step*int64(i+1)
+		ts := int64(s.Values[0] * 10e12)
+
+		assert.Equal(t, p, s.Time, "samples should be at points of the interval")
+		assert.True(t, ts > p-2*width-int64(time.Millisecond) && ts <= p+int64(time.Millisecond), "sample %d at %d should have a row of %d", i, p, ts)
 	}
 
-	fmt.Println("> all messages out, sleeping for 2 seconds")
-	time.Sleep(time.Millisecond * 3000)
+	// closed points are cached, only the open ones are queried again
+	again := td.getData(t, start, end, tag)
 
-	want0, _ := td.db.getIntervalSample(tag, start, start+interval)
-	want99, _ := td.db.getIntervalSample(tag, end-interval, end)
+	assert.Equal(t, res.Samples, again.Samples)
+	assert.Len(t, td.shard.hdb.lastCall().args[3].Data, 1, "only the last point should be open")
 
-	res, _ := getData(td.apiURL(), start, end, tag)
-	// res, _ := db.getSeries(tag, start, end)
-	fmt.Printf("> res: %v\n", res)
+	// a narrower interval is downsampled from raw rows
+	start, end = start+int64(time.Hour)+int64(250*time.Millisecond), start+int64(time.Hour)+int64(50250*time.Millisecond)
 
-	got0 := res.Samples[0]
-	got99 := res.Samples[99]
+	res = td.getData(t, start, end, tag)
 
-	if !reflect.DeepEqual(want0, got0) {
-		t.Errorf("!> incorrect first sample, \nwanted %v, \ngot    %v", want0, got0)
-	}
+	assert.Len(t, res.Samples, 100)
 
-	if !reflect.DeepEqual(want99, got99) {
-		t.Errorf("!> incorrect last sample, wanted %v, got %v", want99, got99)
+	for i, s := range res.Samples {
+		p := start + (end-start)/100*int64(i+1)
+		want, err := td.db.getIntervalSample(tag, start-int64(time.Minute), p)
+
+		assert.NoError(t, err)
+		assert.Equal(t, sample{p, want.Values, nil}, s, "sample %d should have the last row before it", i)
 	}
 }
 
-/*
 func TestAPIResponse(t *testing.T) {
-	td := getTestServer()
-	defer td.stop()
+	td := getTestServer(t)
 
 	start := time.Now().Add(-time.Minute * 30).UnixNano()
 	end := start + time.Duration(20*time.Minute).Nanoseconds()
 
 	tag := "test_tag"
 
-	msg := Msg{end, tag, []float64{1.2}}
+	msg := Msg{end, tag, []float64{1.2}, nil}
 
-	sendPostMessage(td.saveURL(), msg)
+	req := fasthttp.AcquireRequest()
+	req.Header.SetMethod("POST")
+	req.SetRequestURI("http://test.me/save")
 
-	time.Sleep(2 * time.Second)
+	body, _ := json.Marshal(msg)
+	req.AppendBody(body)
 
-	data, err := getData(td.apiURL(), start, end, tag)
+	resp := fasthttp.AcquireResponse()
 
-	if err != nil {
-		t.Fatal("error getting api data")
-	}
+	assert.NoError(t, td.c.Do(req, resp))
+	assert.Equal(t, 200, resp.StatusCode())
 
-	if len(data.Samples) == 0 {
-		t.Fatalf("expected samples")
-	}
+	accepted := time.Now().UnixNano()
+
+	data := td.getData(t, start, end, tag, fmt.Sprintf("waitFor=%d", accepted), "timeout=5s")
+	expected := APIResponse{tag, start, end, Samples{{end, msg.Values, nil}}, data.VisibleUntil}
+
+	assert.Equal(t, expected, data, "only the point at the end should have the saved value")
+	assert.True(t, data.VisibleUntil >= accepted, "the saved row should be visible")
+}
+
+func TestAPIWaitForTimeout(t *testing.T) {
+	td := getTestServer(t)
+
+	// hdb doesn't see new batches
+	td.shard.store.mu.Lock()
+	td.shard.store.visible = time.Now().Add(-time.Minute).UnixNano()
+	td.shard.store.mu.Unlock()
+
+	td.in <- randMsg(time.Now().UnixNano(), "t1")
+
+	waitFor, end := time.Now().UnixNano(), time.Now().UnixNano()
+
+	s := time.Now()
+	data := td.getData(t, end-int64(time.Hour), end, "t1", fmt.Sprintf("waitFor=%d", waitFor), "timeout=200ms")
 
-	mockSample := sample{data.Samples[0].Time, msg.Values} // rounding error
+	assert.True(t, time.Now().Sub(s) >= 200*time.Millisecond, "should wait for the timeout")
+	assert.True(t, data.VisibleUntil < waitFor, "the timed out wait should be told by visibleUntil")
 
-	expected := APIResponse{tag, start, end, []sample{mockSample}}
+	for _, args := range []string{"waitFor=soon", "waitFor=1&timeout=2", "waitFor=1&timeout=-1s"} {
+		code, _, _ := td.c.Get(nil, fmt.Sprintf("http://test.me/api?start=%d&end=%d&tag=t1&%s", end-int64(time.Hour), end, args))
 
-	if !reflect.DeepEqual(data, expected) {
-		t.Fatalf("Incorrect API response, \nwanted: %+v, \ngot   : %+v", expected, data)
+		assert.Equal(t, 400, code, args)
 	}
 }
-*/
@@ -2,74 +2,198 @@ package main
 
 import (
 	"fmt"
-	"log"
-	"os"
-	"strconv"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	kdb "github.com/sv/kdbgo"
 )
 
-// KDB provides a struct to call `tp` and `hdb` connections
-// also provides a `batch chan` for `saveBatch`
-// implements `Database` interfaces
+// KDB provides a struct to call `tp` and `hdb` connections of each shard,
+// tags are assigned to shards by `ring`. also provides a `batch chan` and a
+// `tp` connection for each `saveBatch` worker, `batch.workers` per shard:
+// worker `w` saves to shard `w / batch.workers`. implements `Database`
+// interfaces. with replication, `replicaTP` and `replicaHDB` are parallel to
+// `tp` and `hdb`, nil for shards without a replica
 type KDB struct {
-	tp  *kdb.KDBConn
-	hdb *kdb.KDBConn
-	out chan []*kdb.K
+	tp         []*kdbConn
+	hdb        []*kdbConn
+	replicaTP  []*kdbConn
+	replicaHDB []*kdbConn
+	out        []chan batch
+	ring       *ring
+	state      *kdbState
 }
 
-// connects to `tp` and `hdb` instances and initializes a `db.out` batch
-// channel for `db.saveBatch()`
+// kdbState is shared by copies of `KDB`, since its methods have value receivers
+type kdbState struct {
+	in        chan Msg
+	lastFlush int64
+	// rows sent to db.out, but not yet acknowledged by tp
+	pending int64
+	// done, once all `saveBatch` workers have sent everything from closed db.out
+	saved sync.WaitGroup
+	// rows, that one of the shard's backends missed with `replication.ack` one
+	gaps *gapLog
+	// sequence number of the last batch sent by each worker, only used by
+	// the worker's `saveBatch`
+	seqs []int64
+	// held while a worker's batch is being saved by each of its backends,
+	// including the background ones with ack one
+	sending [][2]sync.Mutex
+	// this app instance, see instanceName
+	instance string
+	// ingest watermark, see `visibleUntil`
+	visibility *visibility
+	// hdb watermark polls of each shard, see `waitVisible`
+	polls []*watermarkPoll
+}
+
+// pause before resending a batch, that `tp` failed to accept
+const retryInterval = 100 * time.Millisecond
+
+// kdbRows is a batch of `(tag; ts; values)` rows, sortable by `ts`, so
+// `.tmp.t`, declared as `s#ts` on the kdb+ side, stays sorted
+type kdbRows []*kdb.K
+
+func (rows kdbRows) Len() int {
+	return len(rows)
+}
+
+func (rows kdbRows) Less(i, j int) bool {
+	return rowTs(rows[i]) < rowTs(rows[j])
+}
+
+func (rows kdbRows) Swap(i, j int) {
+	rows[i], rows[j] = rows[j], rows[i]
+}
+
+func rowTs(row *kdb.K) int64 {
+	return row.Data.([]*kdb.K)[1].Data.(int64)
+}
+
+// lateness tracks the newest timestamp seen per tag, and rejects messages
+// arriving later than `window` behind it. Rows inside the window are
+// accepted, and merged into already sealed partitions by `.P.write`
+type lateness struct {
+	window int64
+	newest map[string]int64
+}
+
+func newLateness(window time.Duration) lateness {
+	return lateness{window.Nanoseconds(), make(map[string]int64)}
+}
+
+func (l lateness) accept(m Msg) bool {
+	newest, ok := l.newest[m.Tag]
+
+	if !ok || m.Time > newest {
+		l.newest[m.Tag] = m.Time
+		return true
+	}
+
+	return m.Time >= newest-l.window
+}
+
+// connects to configured shards, see newKDB
 func getKDB() Database {
-	tpHost := os.Getenv("TP_HOST")
+	return newKDB(conf.shards())
+}
+
+// connects to each shard's `tp` once per `saveBatch` worker and to its
+// `hdb`, and to their replicas, if the shard has them. initializes a
+// `db.out` batch channel for each worker
+func newKDB(shards []shardConfig) KDB {
+	var tp, hdb, replicaTP, replicaHDB []*kdbConn
+	var out []chan batch
+	var names []string
+
+	for _, s := range shards {
+		for i := 0; i < conf.Batch.Workers; i++ {
+			tp = append(tp, mustDial(fmt.Sprintf("%s.tp%d", s.Name, i), s.TP))
+			replicaTP = append(replicaTP, nil)
+			out = append(out, make(chan batch, conf.Queue.Batches))
+
+			if s.Replica.TP.Host != "" {
+				replicaTP[len(replicaTP)-1] = mustDial(fmt.Sprintf("%s.replica.tp%d", s.Name, i), s.Replica.TP)
+			}
+		}
+
+		logger.info("connected to tp", "shard", s.Name, "host", s.TP.Host, "port", s.TP.Port, "workers", conf.Batch.Workers)
+
+		hdb = append(hdb, mustDial(s.Name+".hdb", s.HDB))
+		replicaHDB = append(replicaHDB, nil)
+
+		logger.info("connected to hdb", "shard", s.Name, "host", s.HDB.Host, "port", s.HDB.Port)
+
+		if s.Replica.TP.Host != "" {
+			replicaHDB[len(replicaHDB)-1] = mustDial(s.Name+".replica.hdb", s.Replica.HDB)
+
+			logger.info("connected to replica", "shard", s.Name, "tp", s.Replica.TP, "hdb", s.Replica.HDB, "ack", conf.Replication.Ack)
+		}
 
-	if tpHost == "" {
-		tpHost = "127.0.0.1"
+		names = append(names, s.Name)
 	}
 
-	tpPort, err := strconv.Atoi(os.Getenv("TP_PORT"))
+	state := &kdbState{lastFlush: time.Now().UnixNano(), gaps: &gapLog{path: conf.Replication.GapLog}, seqs: make([]int64, len(tp)), sending: make([][2]sync.Mutex, len(tp)), instance: instanceName(), visibility: newVisibility(len(tp))}
 
-	if err != nil {
-		tpPort = 6012
+	db := KDB{tp, hdb, replicaTP, replicaHDB, out, newRing(names), state}
+
+	for range hdb {
+		state.polls = append(state.polls, newWatermarkPoll())
 	}
 
-	hdbHost := os.Getenv("HDB_HOST")
+	for worker := range tp {
+		seq, err := db.lastSeq(worker)
+
+		if err != nil {
+			logger.error("can't get the last journaled batch", "conn", tp[worker].name, "error", err)
+			panic(err)
+		}
 
-	if hdbHost == "" {
-		hdbHost = "127.0.0.1"
+		state.seqs[worker] = seq
 	}
 
-	hdbPort, err := strconv.Atoi(os.Getenv("HDB_PORT"))
+	return db
+}
+
+// mustDial connects to `addr`, panics if it can't
+func mustDial(name string, addr kdbAddr) *kdbConn {
+	c, err := dialKDB(name, addr.Host, addr.Port)
 
 	if err != nil {
-		hdbPort = 6013
+		logger.error("can't connect to kdb+", "conn", name, "host", addr.Host, "port", addr.Port, "error", err)
+		panic(err)
 	}
 
-	var tp, hdb *kdb.KDBConn
+	return c
+}
 
-	if tp, err = kdb.DialKDB(tpHost, tpPort, ""); err != nil {
-		log.Panicf("!> Failed to connect to tp: %s:%d, %v", tpHost, tpPort, err)
-	} else {
-		log.Printf("> Connected to tp: %s:%d", tpHost, tpPort)
-	}
+// all connections, including replicas
+func (db KDB) conns() []*kdbConn {
+	var conns []*kdbConn
 
-	if hdb, err = kdb.DialKDB(hdbHost, hdbPort, ""); err != nil {
-		log.Panicf("Failed to connect to hdb: %s:%d, %v", hdbHost, hdbPort, err)
-	} else {
-		log.Printf("> Connected to hdb: %s:%d", hdbHost, hdbPort)
+	for _, group := range [][]*kdbConn{db.tp, db.hdb, db.replicaTP, db.replicaHDB} {
+		for _, c := range group {
+			if c != nil {
+				conns = append(conns, c)
+			}
+		}
 	}
 
-	return KDB{tp, hdb, make(chan []*kdb.K, 5)}
+	return conns
+}
+
+// workerOf returns `saveBatch` worker of `tag`, on its shard
+func (db KDB) workerOf(tag string) int {
+	return db.ring.shard(tag)*conf.Batch.Workers + workerOf(tag, conf.Batch.Workers)
 }
 
 // used in tests: gets last entry in the provided interval from the DB
 func (db KDB) getIntervalSample(tag string, start int64, end int64) (sample, error) {
-	q := fmt.Sprintf("-1#select from t where int=`int$`sym$`%s,ts > %d,ts <= %d", tag, start, end)
-
-	log.Printf("> kdb.getIntervalSample: %v", q)
-
-	res, err := db.q(q)
+	res, err := db.q(tag, ".P.last_tag", exportArgs(tag, start, end)...)
 
 	if err != nil {
 		return sample{}, err
@@ -78,53 +202,620 @@ func (db KDB) getIntervalSample(tag string, start int64, end int64) (sample, err
 	// d := res.Data.(kdb.Dict)
 	d := res.Data.(kdb.Table)
 
-	log.Printf("> values: %v\n\n", d.Data[3].Data)
-	log.Printf("> values: %v\n\n", d.Data[3].Data.([]*kdb.K)[0].Data.([]float64))
+	ts := d.Data[0].Data.([]int64)
+	values := d.Data[1].Data.([]*kdb.K)
 
-	ts := d.Data[2].Data.([]int64)
-	values := d.Data[3].Data.([]*kdb.K)
+	vals, typed, _ := cellValues(values[0])
 
-	return sample{ts[0], values[0].Data.([]float64)}, nil
+	return sample{ts[0], vals, typed}, nil
 }
 
-// calls downsampling function on hdb
+// a tag's value as of a series point. `src` is the time of the raw row or
+// the rollup bucket it's from, or, without a value, the lookback bound it
+// was sampled with. values of typed tags are in `typed`
+type pointSample struct {
+	time   int64
+	src    int64
+	values []float64
+	typed  []interface{}
+}
+
+func (p pointSample) empty() bool {
+	return p.values == nil && p.typed == nil
+}
+
+// sampler samples a tag's values as of `points`, from tier `t`, or raw
+// rows if it's nil, looking back to rows or buckets after `lo`
+type sampler func(t *tier, lo int64, points []int64) ([]pointSample, error)
+
 func (db KDB) getSeries(tag string, start int64, end int64) (APIResponse, error) {
-	// log.Printf("> kdb.getSeries %s, %d, %d\n", tag, start, end)
-	// s := time.Now()
+	return series(db, tag, start, end, func(t *tier, lo int64, points []int64) ([]pointSample, error) {
+		return db.samplePoints(tag, t, lo, points)
+	})
+}
 
-	var samples Samples
+// series samples 100 points of (start; end], on the coarsest rollup tier
+// with buckets no wider than the requested ones, or on raw rows, if
+// there's none or the tier query fails, e.g. for partitions without
+// rollups yet. the watermark is read before the query, so the query sees
+// at least the messages it reports as visible
+func series(db Database, tag string, start int64, end int64, sample sampler) (APIResponse, error) {
+	visible, err := db.visibleUntil(tag)
+
+	if err != nil {
+		logger.error("hdb watermark query failed", "tag", tag, "error", err)
+		return APIResponse{}, err
+	}
+
+	points := seriesPoints(start, end)
+	expiry := expiredBefore(tag)
+
+	if t := tierFor((end - start) / 100); t != nil {
+		ps, err := sample(t, lookback(start, t, expiry), points)
+
+		if err == nil {
+			return APIResponse{tag, start, end, samplesOf(ps), visible}, nil
+		}
 
-	q := fmt.Sprintf(".P.downsample_tag[`%s; %d; %d]", tag, start, end)
+		logger.every("getSeries.tier", time.Second).warn("rollup query failed, sampling raw rows", "tag", tag, "tier", t.name, "error", err)
+	}
 
-	res, err := db.q(q)
+	ps, err := sample(nil, lookback(start, nil, expiry), points)
 
 	if err != nil {
-		log.Printf("!> Query failed: %v \n%s\n\n", err, q)
+		logger.error("hdb query failed", "tag", tag, "fn", ".P.sample_tag", "error", err)
 		return APIResponse{}, err
 	}
 
+	return APIResponse{tag, start, end, samplesOf(ps), visible}, nil
+}
+
+// seriesPoints are 100 points of (start; end], a rounded hundredth of it
+// apart
+func seriesPoints(start int64, end int64) []int64 {
+	step := int64(math.Round(float64(end-start) / 100))
+	points := make([]int64, 100)
+
+	for i := range points {
+		points[i] = start + step*int64(i+1)
+	}
+
+	return points
+}
+
+// lookback bound of values of series starting at `start`: any raw row, or
+// tier's buckets ending after it, and neither before retention's `expiry`
+func lookback(start int64, t *tier, expiry int64) int64 {
+	lo := expiry - 1
+
+	if t != nil && start-int64(t.width) > lo {
+		lo = start - int64(t.width)
+	}
+
+	return lo
+}
+
+// sampledDates are partitions `.P.sample_*` query for `points` after `lo`.
+// raw rows are read from a day before the first point's date, hdb falls
+// back to the newest earlier partition holding the tag only for a tag
+// without rows there
+func sampledDates(t *tier, lo int64, points []int64) *kdb.K {
+	day := int64(24 * time.Hour)
+	from := lo + 1
+
+	if t == nil && bucketOf(points[0], day)-day > from {
+		from = bucketOf(points[0], day) - day
+	}
+
+	return qDates(from, points[len(points)-1])
+}
+
+// samplePoints calls sampling function of tier `t`, or of raw rows, on hdb
+func (db KDB) samplePoints(tag string, t *tier, lo int64, points []int64) ([]pointSample, error) {
+	fn, name := ".P.sample_tag", "raw"
+	args := []*kdb.K{kdb.Symbol(tag), kdb.Long(lo), kdb.Atom(kdb.KJ, points), sampledDates(t, lo, points)}
+
+	if t != nil {
+		fn, name = ".P.sample_rollup", t.name
+		args = append([]*kdb.K{kdb.Symbol(t.name)}, args...)
+	}
+
+	res, err := db.q(tag, fn, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seriesQueries.inc(name)
+
 	d := res.Data.(kdb.Table)
-	ts := d.Data[1].Data.([]int64)
-	values := d.Data[3].Data.([]*kdb.K)
+
+	ts := d.Data[0].Data.([]int64)
+	src := d.Data[1].Data.([]int64)
+	values := d.Data[2].Data.([]*kdb.K)
+
+	ps := make([]pointSample, len(ts))
 
 	for i := range ts {
-		vals, ok := values[i].Data.([]float64)
+		ps[i] = pointSample{ts[i], lo, nil, nil}
+
+		if vals, typed, ok := cellValues(values[i]); ok {
+			ps[i] = pointSample{ts[i], src[i], vals, typed}
+		}
+	}
+
+	return ps, nil
+}
+
+// visible is shard's hdb watermark: rows, that tp acknowledged before it,
+// are visible to queries. tp moves it after each flush
+func (db KDB) visible(shard int) (int64, error) {
+	res, err := db.hdbCall(shard, ".P.visible_until[]")
+
+	if err != nil {
+		return 0, err
+	}
+
+	wm, ok := res.Data.(int64)
+
+	if !ok {
+		return 0, fmt.Errorf("unexpected .P.visible_until result %v", res)
+	}
+
+	return wm, nil
+}
+
+// tagWrites of a tag, as hdb sees them: its watermark `at`, the tag's newest
+// row, 0 if it has none, and its oldest row written after an existing newer
+// one, e.g. by catchup or rebalance, since watermark `since`. `stale` is 0 if
+// there's none, and math.MinInt64 if hdb doesn't know, e.g. as it restarted
+type tagWrites struct {
+	at     int64
+	newest int64
+	stale  int64
+}
+
+// tagWrites of `tag` since hdb watermark `since`, see `.P.tag_writes`
+func (db KDB) tagWrites(tag string, since int64) (tagWrites, error) {
+	res, err := db.q(tag, ".P.tag_writes", kdb.Symbol(tag), kdb.Long(since))
+
+	if err != nil {
+		return tagWrites{}, err
+	}
+
+	w, ok := res.Data.([]int64)
+
+	if !ok || len(w) != 3 {
+		return tagWrites{}, fmt.Errorf("unexpected .P.tag_writes result %v", res)
+	}
+
+	return tagWrites{w[0], w[1], w[2]}, nil
+}
+
+// visibleUntil is the ingest watermark of the tag's shard: messages, that
+// `/save` accepted before it, are acknowledged by tp, and hdb watermark
+// passed their acknowledgement
+func (db KDB) visibleUntil(tag string) (int64, error) {
+	shard := db.ring.shard(tag)
+
+	hdb, err := db.visible(shard)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return db.ingestWatermark(shard, hdb), nil
+}
+
+// ingestWatermark of `shard`, whose hdb watermark is `hdb`
+func (db KDB) ingestWatermark(shard int, hdb int64) int64 {
+	workers := make([]int, conf.Batch.Workers)
+
+	for i := range workers {
+		workers[i] = shard*conf.Batch.Workers + i
+	}
+
+	return db.state.visibility.until(workers, hdb)
+}
+
+// waitVisible waits until messages accepted before `waitFor` are visible in
+// the tag's shard, for up to `timeout`. waiters of a shard share its hdb
+// watermark polls
+func (db KDB) waitVisible(tag string, waitFor int64, timeout time.Duration) {
+	shard := db.ring.shard(tag)
+
+	db.waitHDB(shard, timeout, func(hdb int64) bool { return db.ingestWatermark(shard, hdb) >= waitFor })
+}
+
+// observeLag observes ingest lag of a batch, that tp acknowledged at `at`,
+// once the shard's hdb sees it, or after `maxLagWait`
+func (db KDB) observeLag(shard int, at int64, received time.Time) {
+	db.waitHDB(shard, maxLagWait, func(hdb int64) bool { return hdb >= at })
+
+	ingestLag.observe(time.Now().Sub(received).Seconds())
+}
+
+// waitHDB waits until `done` is true of the shard's hdb watermark, for up to
+// `timeout`, sharing the shard's polls
+func (db KDB) waitHDB(shard int, timeout time.Duration, done func(hdb int64) bool) {
+	p := db.state.polls[shard]
+	deadline := time.After(timeout)
+
+	p.join(func() (int64, error) { return db.visible(shard) })
+	defer p.leave()
+
+	for {
+		hdb, polled := p.last()
+
+		if hdb != 0 && done(hdb) {
+			return
+		}
+
+		select {
+		case <-polled:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// samples of points with values
+func samplesOf(ps []pointSample) Samples {
+	var samples Samples
+
+	for _, p := range ps {
+		if !p.empty() {
+			samples = append(samples, sample{p.time, p.values, p.typed})
+		}
+	}
+
+	return samples
+}
+
+// all stored tags of all shards, including other tenants' ones
+func (db KDB) getTags() ([]string, error) {
+	var all []string
+
+	for shard := range db.hdb {
+		tags, err := db.shardTags(shard)
+
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, tags...)
+	}
+
+	return all, nil
+}
+
+// tags stored on a shard, including the ones it doesn't own after a
+// rebalance
+func (db KDB) shardTags(shard int) ([]string, error) {
+	res, err := db.hdbCall(shard, ".P.list_tags[]")
+
+	if err != nil {
+		return nil, err
+	}
 
-		if !ok {
+	tags, ok := res.Data.([]string)
+
+	if !ok {
+		return nil, fmt.Errorf("unexpected .P.list_tags result %v", res)
+	}
+
+	return tags, nil
+}
+
+// raw rows of a tag in the interval, from its shard
+// exportSeries skips rows, that retention expired
+func (db KDB) exportSeries(tag string, start int64, end int64) (Samples, error) {
+	if expiry := expiredBefore(tag); start < expiry-1 {
+		start = expiry - 1
+	}
+
+	return db.exportShard(db.ring.shard(tag), tag, start, end)
+}
+
+// raw rows of a tag in the interval, stored on `shard`
+func (db KDB) exportShard(shard int, tag string, start int64, end int64) (Samples, error) {
+	res, err := db.hdbCall(shard, ".P.export_tag", exportArgs(tag, start, end)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return exportRows(res), nil
+}
+
+// exportArgs are `(tag; start; end; dates)` arguments of hdb functions,
+// that read a tag's rows in (start; end]. tags are passed as symbols, never
+// formatted into q, so any tag is just data to hdb
+func exportArgs(tag string, start int64, end int64) []*kdb.K {
+	return []*kdb.K{kdb.Symbol(tag), kdb.Long(start), kdb.Long(end), qDates(start, end)}
+}
+
+// days from 2000.01.01, q's epoch, to 1970.01.01
+const qEpochDays = 10957
+
+// qDates is a q pair of UTC dates of `start` and `end`, partitions that
+// hold rows of the interval, so hdb only maps those
+func qDates(start int64, end int64) *kdb.K {
+	day := int64(24 * time.Hour)
+
+	return kdb.Atom(kdb.KD, []int32{int32(bucketOf(start, day)/day - qEpochDays), int32(bucketOf(end, day)/day - qEpochDays)})
+}
+
+// samples of `.P.export_tag` result
+func exportRows(res *kdb.K) Samples {
+	var samples Samples
+
+	d := res.Data.(kdb.Table)
+	ts := d.Data[0].Data.([]int64)
+	values := d.Data[1].Data.([]*kdb.K)
+
+	for i := range ts {
+		if vals, typed, ok := cellValues(values[i]); ok {
+			samples = append(samples, sample{ts[i], vals, typed})
+		}
+	}
+
+	return samples
+}
+
+// valuesK is the values cell of a row: a float list, or a general list of
+// atoms of `typed` values, with float nulls for nils. tp stores general
+// lists serialized, see `.P.pack`
+func valuesK(values []float64, typed []interface{}) *kdb.K {
+	if typed == nil {
+		return kdb.Atom(kdb.KF, values)
+	}
+
+	atoms := make([]*kdb.K, len(typed))
+
+	for i, v := range typed {
+		switch v := v.(type) {
+		case float64:
+			atoms[i] = kdb.Float(v)
+		case int64:
+			atoms[i] = kdb.Long(v)
+		case bool:
+			atoms[i] = kdb.Atom(-kdb.KB, v)
+		case string:
+			atoms[i] = kdb.Atom(kdb.KC, v)
+		default:
+			atoms[i] = kdb.Float(math.NaN())
+		}
+	}
+
+	return kdb.NewList(atoms...)
+}
+
+// cellValues decodes a values cell of valuesK, nulls of typed ones are
+// nils. it's not `ok` without values, e.g. for an empty list, that aj
+// fills points without rows before them with
+func cellValues(k *kdb.K) ([]float64, []interface{}, bool) {
+	switch v := k.Data.(type) {
+	case []float64:
+		return v, nil, true
+	case []*kdb.K:
+		if len(v) == 0 {
+			return nil, nil, false
+		}
+
+		typed := make([]interface{}, len(v))
+
+		for i, a := range v {
+			switch x := a.Data.(type) {
+			case float64:
+				if !math.IsNaN(x) {
+					typed[i] = x
+				}
+			case int64:
+				if x != math.MinInt64 {
+					typed[i] = x
+				}
+			case bool, string:
+				typed[i] = x
+			}
+		}
+
+		return nil, typed, true
+	}
+
+	return nil, nil, false
+}
+
+// prune drops date partitions of every shard, and of replicas, that only
+// hold tags with `cutoff` at or after the partition's end, so all of their
+// rows expired. in partitions, that other tags keep, rows of expired tags
+// are dropped by `.P.prune_tag`, that rewrites the partition once. rows of
+// a tag, that only partly expired in a partition, stay on disk until its
+// cutoff passes the partition's end, reads skip them. `.P.drop_date` and
+// `.P.prune_tag` run on `tp`, between upserts, so they never race with
+// ingestion. returns partitions and rows dropped on primaries
+func (db KDB) prune(cutoff func(tag string) int64) (int, int, error) {
+	day := int64(24 * time.Hour)
+	partitions, rows := 0, 0
+
+	for shard := range db.hdb {
+		res, err := db.hdbCall(shard, ".P.date_tags[]")
+
+		if err != nil {
+			return partitions, rows, err
+		}
+
+		d := res.Data.(kdb.Table)
+		days := d.Data[0].Data.([]int64)
+		tags := d.Data[1].Data.([]*kdb.K)
+
+		for i, n := range days {
+			exp, all := expiredTags(tags[i], (n+1)*day, cutoff)
+
+			if len(exp) == 0 {
+				continue
+			}
+
+			fn, args := ".P.drop_date", []*kdb.K{kdb.Long(n)}
+
+			if !all {
+				fn, args = ".P.prune_tag", append(args, kdb.SymbolV(exp))
+			}
+
+			for j, tp := range db.writers(shard * conf.Batch.Workers) {
+				res, err := tp.call(fn, args...)
+
+				if err != nil {
+					return partitions, rows, fmt.Errorf("can't prune %s partition %s on %s: %v", db.shardName(shard), time.Unix(0, n*day).UTC().Format("2006-01-02"), tp.name, err)
+				}
+
+				if dropped, ok := res.Data.(int64); ok && j == 0 {
+					rows += int(dropped)
+
+					if all {
+						partitions++
+					}
+				}
+			}
+		}
+	}
+
+	return partitions, rows, nil
+}
+
+// expiredTags of `tags` of a partition ending at `end`, that have cutoffs
+// at or after it, and if that's all of them
+func expiredTags(tags *kdb.K, end int64, cutoff func(tag string) int64) ([]string, bool) {
+	list, ok := tags.Data.([]string)
+
+	if !ok {
+		return nil, false
+	}
+
+	var exp []string
+
+	for _, tag := range list {
+		if c := cutoff(tag); c != 0 && c >= end {
+			exp = append(exp, tag)
+		}
+	}
+
+	return exp, len(exp) == len(list)
+}
+
+// health of `tp` and `hdb` connections and their replicas, msgChan and db.out queues, and
+// of the batch flushes
+func (db KDB) health() map[string]healthStatus {
+	h := make(map[string]healthStatus)
+
+	for _, c := range db.conns() {
+		h[c.name] = c.ping(time.Second)
+	}
+
+	var err error
+
+	saturation := conf.Health.QueueSaturation
+
+	in, out := len(db.state.in), db.queued()
+
+	if float64(in) >= saturation*float64(cap(db.state.in)) {
+		err = fmt.Errorf("msgChan is saturated")
+	}
+
+	for i, o := range db.out {
+		if float64(len(o)) >= saturation*float64(cap(o)) {
+			err = fmt.Errorf("db.out of worker %d is saturated", i)
+		}
+	}
+
+	h["queue"] = statusOf(err, "msgChan", in, "msgChanCap", cap(db.state.in), "batches", out, "batchesCap", len(db.out)*conf.Queue.Batches)
+
+	err = nil
+
+	lastFlush := time.Unix(0, atomic.LoadInt64(&db.state.lastFlush))
+	age := time.Now().Sub(lastFlush)
+
+	if out > 0 && age > conf.Health.FlushStale {
+		err = fmt.Errorf("no successful flush for %v, with %d batches waiting", age, out)
+	}
+
+	h["flush"] = statusOf(err, "lastFlush", lastFlush, "age", age)
+	h["visible"] = db.visibility()
+
+	return h
+}
+
+// visibility reports hdb watermarks of shards, failing if one can't be read,
+// or is older than `health.flushStale`, e.g. when tp can't reach its hdb
+func (db KDB) visibility() healthStatus {
+	var err error
+	var kv []interface{}
+
+	for shard := range db.hdb {
+		wm, werr := db.visible(shard)
+
+		if werr != nil {
+			err = fmt.Errorf("can't get watermark of %s: %v", db.shardName(shard), werr)
 			continue
 		}
 
-		samples = append(samples, sample{ts[i], vals})
+		age := time.Now().Sub(time.Unix(0, wm))
+
+		if age > conf.Health.FlushStale {
+			err = fmt.Errorf("rows of %s are visible up to %v ago", db.shardName(shard), age)
+		}
+
+		kv = append(kv, db.shardName(shard), time.Unix(0, wm))
+	}
+
+	return statusOf(err, kv...)
+}
+
+// stop closes msgChan, so the consumer flushes its partial batch, waits up
+// to `timeout` for `saveBatch` to send all batches to `tp` and closes kdb+
+// connections. returns the number of messages, that weren't sent.
+// nothing must be sent to msgChan after stop is called
+func (db KDB) stop(timeout time.Duration) int {
+	close(db.state.in)
+
+	saved := make(chan struct{})
+
+	go func() {
+		db.state.saved.Wait()
+		close(saved)
+	}()
+
+	select {
+	case <-saved:
+	case <-time.After(timeout):
+		logger.error("timed out waiting for batches to be saved", "timeout", timeout)
 	}
 
-	// log.Printf("> %v getSeries(%s, %d, %d)\n", time.Now().Sub(s), tag, start, end)
+	lost := len(db.state.in) + int(atomic.LoadInt64(&db.state.pending))
+
+	for _, c := range db.conns() {
+		if err := c.close(); err != nil {
+			logger.warn("can't close kdb+ connection", "conn", c.name, "error", err)
+		}
+	}
 
-	return APIResponse{tag, start, end, samples}, nil
+	return lost
+}
+
+// batches waiting in all of db.out queues
+func (db KDB) queued() int {
+	n := 0
+
+	for _, o := range db.out {
+		n += len(o)
+	}
+
+	return n
 }
 
 // queries on `tp`, not used atm
 func (db KDB) query(q string) error {
-	_, err := db.tp.Call(q)
+	_, err := db.tp[0].call(q)
 
 	if err != nil {
 		return err
@@ -133,64 +824,150 @@ func (db KDB) query(q string) error {
 	return nil
 }
 
-// client queries on `hdb`
-func (db KDB) q(q string) (*kdb.K, error) {
-	// log.Printf("> kdb.q: %v", q)
-	return db.hdb.Call(q)
+// client queries on `hdb` of the shard, that owns `tag`, or on its replica
+func (db KDB) q(tag string, fn string, args ...*kdb.K) (*kdb.K, error) {
+	return db.hdbCall(db.ring.shard(tag), fn, args...)
 }
 
-func (db KDB) saveBatch() {
-	for rows := range db.out {
+// sends batches from worker's `db.out` to `tp` and its replica, see `send`.
+// returns once its db.out is closed and drained
+func (db KDB) saveBatch(worker int) {
+	for b := range db.out[worker] {
 		s := time.Now()
 
-		log.Printf("> %v %d --> saveBatch: \n", time.Now(), len(rows))
+		at := db.send(worker, b)
 
-		if _, err := db.tp.Call(".P.tp_add", kdb.NewList(rows...)); err != nil {
-			log.Printf("!!!!!!> can't upsert to .tmp.n: %s, returning to db.outr", err)
-			db.out <- rows
-			continue
+		db.state.visibility.ack(worker, at)
+
+		done := time.Now().Sub(s)
+
+		atomic.StoreInt64(&db.state.lastFlush, time.Now().UnixNano())
+		atomic.AddInt64(&db.state.pending, -int64(len(b.rows)))
+
+		batchRows.observe(float64(len(b.rows)))
+		batchFlush.observe(done.Seconds())
+
+		if at != 0 {
+			go db.observeLag(worker/conf.Batch.Workers, at, b.received)
 		}
 
-		log.Printf("> %v %d <-- saveBatch\n", time.Now().Sub(s), len(rows))
+		logger.every("saveBatch", 10*time.Second).info("batch saved", "worker", worker, "batch", len(b.rows), "bytes", b.bytes, "duration", done, "queue", db.queued())
 	}
 }
 
-// starts 2 goroutines:
-// - one reading from incoming messages `msgChan` channel,
-// batching them once per predefined tick interval.
-// - another is batch sender, getting batches from `d.out` 'batch chan'
+// starts `batch.workers` + 1 goroutines:
+// - one reading from incoming messages `msgChan` channel, adding them to a
+// batch of the worker, that handles their tag. a batch is sent to the
+// worker's db.out once it reaches `batch.maxRows`, `batch.maxBytes` or
+// `batch.maxAge`. messages later than `batch.lateWindow` for their tag are
+// dropped, and each batch is sorted by `ts` before it's sent. once msgChan
+// is closed, partial batches are flushed and db.out queues are closed.
+// - `saveBatch` workers, each getting batches from its `db.out` 'batch chan'
 // returns msgChan, so it can be used by saveHandler API
 func (db KDB) startQueueConsumer() chan Msg {
 	// channel of incoming parsed messages, arriving from saveHandler
-	msgChan := make(chan Msg, 100000)
+	msgChan := make(chan Msg, conf.Queue.Messages)
+
+	db.state.in = msgChan
+
+	// start background batch savers, each reading from its `db.out` channel
+	for i := range db.out {
+		db.state.saved.Add(1)
+
+		go func(worker int) {
+			db.saveBatch(worker)
+			db.state.saved.Done()
+		}(i)
+	}
+
+	msgQueueDepth.set(func() float64 { return float64(len(msgChan)) })
+	batchQueueDepth.set(func() float64 { return float64(db.queued()) })
+
+	batches := newBatcher(len(db.out), conf.Batch.MaxRows, conf.Batch.MaxBytes, conf.Batch.MaxAge)
+
+	late := newLateness(conf.Batch.LateWindow)
+
+	known, err := db.getTags()
+
+	if err != nil {
+		logger.warn("can't get stored tags, tenants' tag counts start from 0", "error", err)
+	}
+
+	quota := newQuotas(conf.Tenants, known)
+
+	flush := func(worker int) {
+		b := batches.take(worker)
+
+		sort.Stable(kdbRows(b.rows))
 
-	timer := time.Tick(time.Second)
+		atomic.AddInt64(&db.state.pending, int64(len(b.rows)))
 
-	// start backgroup batch saver, reading from `db.out` channel
-	// add more here to parallelize batch inserts into DB
-	go db.saveBatch()
+		db.state.visibility.flush(worker)
 
-	var rowBatch []*kdb.K
+		db.out[worker] <- b
+
+		logger.debug("batch queued", "worker", worker, "batch", len(b.rows), "bytes", b.bytes, "queue", len(db.out[worker]))
+	}
+
+	ticker := time.NewTicker(batches.tick())
+
+	// messages taken from msgChan, for the ingest watermark
+	var taken int64
 
 	// launch a goroutine, that adds each incoming message from msgChan
-	// to a batch in DB specific format, and sends it to db.out once in
-	// timer.Tick
+	// to a batch in DB specific format, and sends it to db.out once
+	// the batch is full or old enough
 	go func() {
+		defer ticker.Stop()
+
 		for {
 			select {
-			case <-timer:
-				if len(rowBatch) == 0 {
-					fmt.Printf(".")
+			case now := <-ticker.C:
+				db.state.visibility.sample(now.UnixNano(), len(msgChan), taken)
+
+				for _, worker := range batches.expired(now) {
+					flush(worker)
+				}
+			case m, ok := <-msgChan:
+				if !ok {
+					for worker := range db.out {
+						if len(batches.parts[worker].rows) > 0 {
+							flush(worker)
+						}
+
+						close(db.out[worker])
+					}
+
+					return
+				}
+
+				taken++
+
+				if !late.accept(m) {
+					n := msgRejected.inc("late")
+					logger.every("late", time.Second).warn("dropped late message", "tag", m.Tag, "time", m.Time, "dropped", n)
+					continue
+				}
+
+				if ok, reason := quota.accept(m, time.Now()); !ok {
+					n := msgRejected.inc("quota." + reason)
+					logger.every("quota."+reason, time.Second).warn("dropped message over tenant quota", "quota", reason, "tag", m.Tag, "dropped", n)
 					continue
 				}
 
-				db.out <- rowBatch
+				msgAccepted.inc()
 
-				log.Printf("> %v %d -> saveBatch | batches: %d\n", time.Now(), len(rowBatch), len(db.out))
+				row := kdb.NewList(kdb.Symbol(m.Tag), kdb.Long(m.Time), valuesK(m.Values, m.Typed))
 
-				rowBatch = []*kdb.K{}
-			case m := <-msgChan:
-				rowBatch = append(rowBatch, kdb.NewList(kdb.Symbol(m.Tag), kdb.Long(m.Time), kdb.Atom(kdb.KF, m.Values)))
+				worker := db.workerOf(m.Tag)
+
+				if len(batches.parts[worker].rows) == 0 {
+					db.state.visibility.start(worker)
+				}
+
+				if batches.add(worker, m, row) {
+					flush(worker)
+				}
 			}
 		}
 	}()
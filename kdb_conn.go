@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// kdbConn serializes calls on a single kdb+ connection: kdbgo writes a
+// request and reads its response without any locking. it also remembers
+// the result of the last call, so health checks don't have to wait behind
+// a long running batch insert. a connection, that broke, e.g. when q was
+// restarted, is redialed by the next call
+type kdbConn struct {
+	name string
+	host string
+	port int
+	mu   sync.Mutex
+	// nil once broken, until redialed. set under both locks, so close can
+	// read it while a call runs
+	conn *kdb.KDBConn
+
+	stateMu  sync.Mutex
+	lastCall time.Time
+	lastErr  error
+}
+
+func dialKDB(name string, host string, port int) (*kdbConn, error) {
+	conn, err := kdb.DialKDB(host, port, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &kdbConn{name: name, host: host, port: port, conn: conn}, nil
+}
+
+// call is `h(fn; args...)` on the connection, counting failures in `kdbErrors`
+func (c *kdbConn) call(cmd string, args ...*kdb.K) (*kdb.K, error) {
+	c.mu.Lock()
+	res, err := c.roundTrip(cmd, args...)
+	c.mu.Unlock()
+
+	c.stateMu.Lock()
+	c.lastCall = time.Now()
+	c.lastErr = err
+	c.stateMu.Unlock()
+
+	if err != nil {
+		kdbErrors.inc(c.name)
+	}
+
+	return res, err
+}
+
+// roundTrip redials a broken connection, and drops the connection, if the
+// call broke it. q errors leave it open
+func (c *kdbConn) roundTrip(cmd string, args ...*kdb.K) (*kdb.K, error) {
+	if c.conn == nil {
+		conn, err := kdb.DialKDB(c.host, c.port, "")
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.setConn(conn)
+		kdbReconnects.inc(c.name)
+		logger.info("reconnected to kdb+", "conn", c.name)
+	}
+
+	res, err := c.conn.Call(cmd, args...)
+
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.conn.Close()
+		c.setConn(nil)
+	}
+
+	return res, err
+}
+
+// callTimeout is call, that fails after `timeout`, closing the connection to
+// interrupt it, so a hung kdb+ doesn't block the caller
+func (c *kdbConn) callTimeout(timeout time.Duration, cmd string, args ...*kdb.K) (*kdb.K, error) {
+	type result struct {
+		res *kdb.K
+		err error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		res, err := c.call(cmd, args...)
+		done <- result{res, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.res, r.err
+	case <-time.After(timeout):
+		c.close()
+		return nil, fmt.Errorf("%s timed out after %s", cmd, timeout)
+	}
+}
+
+func (c *kdbConn) setConn(conn *kdb.KDBConn) {
+	c.stateMu.Lock()
+	c.conn = conn
+	c.stateMu.Unlock()
+}
+
+// close the connection, interrupting a running call if there's one
+func (c *kdbConn) close() error {
+	c.stateMu.Lock()
+	conn := c.conn
+	c.stateMu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+// ping does a cheap round trip, unless the connection is busy with another
+// call, in which case result of the last finished call is reported
+func (c *kdbConn) ping(timeout time.Duration) healthStatus {
+	if !c.mu.TryLock() {
+		c.stateMu.Lock()
+		defer c.stateMu.Unlock()
+
+		return statusOf(c.lastErr, "busy", true, "lastCall", c.lastCall)
+	}
+
+	c.mu.Unlock()
+
+	s := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := c.call("1b")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return statusOf(err, "latency", time.Now().Sub(s))
+	case <-time.After(timeout):
+		return healthStatus{Status: statusFail, Error: "ping timed out after " + timeout.String()}
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// fakeCall is a call received by fakeKDB, `h(fn; args...)`
+type fakeCall struct {
+	fn   string
+	args []*kdb.K
+}
+
+// errFakeDrop makes fakeKDB drop the connection instead of replying, like q
+// killed in the middle of a call
+var errFakeDrop = errors.New("drop")
+
+// fakeKDB is an in-process kdb+ server on a local port, speaking q IPC. it
+// records calls and answers them with `handler`, or with its error
+type fakeKDB struct {
+	ln      net.Listener
+	handler func(fakeCall) (*kdb.K, error)
+
+	mu    sync.Mutex
+	calls []fakeCall
+	conns []net.Conn
+}
+
+func newFakeKDB(t testing.TB, handler func(fakeCall) (*kdb.K, error)) *fakeKDB {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+
+	f := &fakeKDB{ln: ln, handler: handler}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+
+			if err != nil {
+				return
+			}
+
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+
+			go f.serve(conn)
+		}
+	}()
+
+	return f
+}
+
+// serve does the handshake, replying with capability 3, and answers sync
+// requests until the client disconnects
+func (f *fakeKDB) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	if _, err := r.ReadBytes(0); err != nil {
+		return
+	}
+
+	if _, err := conn.Write([]byte{3}); err != nil {
+		return
+	}
+
+	for {
+		req, msgtype, err := kdb.Decode(r)
+
+		if err != nil {
+			return
+		}
+
+		c := fakeCall{}
+
+		switch d := req.Data.(type) {
+		case string:
+			c.fn = d
+		case []*kdb.K:
+			c.fn, _ = d[0].Data.(string)
+			c.args = d[1:]
+		}
+
+		f.mu.Lock()
+		f.calls = append(f.calls, c)
+		f.mu.Unlock()
+
+		res, err := f.handler(c)
+
+		if err == errFakeDrop {
+			return
+		}
+
+		if err != nil {
+			res = kdb.Error(err)
+		}
+
+		if msgtype == kdb.SYNC {
+			kdb.Encode(conn, kdb.RESPONSE, res)
+		}
+	}
+}
+
+// addr of the server, for shard configs
+func (f *fakeKDB) addr() kdbAddr {
+	a := f.ln.Addr().(*net.TCPAddr)
+
+	return kdbAddr{a.IP.String(), a.Port}
+}
+
+// dial connects a kdbConn to the server
+func (f *fakeKDB) dial(t testing.TB, name string) *kdbConn {
+	c, err := dialKDB(name, f.addr().Host, f.addr().Port)
+
+	if err != nil {
+		t.Fatalf("can't connect to fake kdb+: %v", err)
+	}
+
+	return c
+}
+
+// lastCall received, zero if none
+func (f *fakeKDB) lastCall() fakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.calls) == 0 {
+		return fakeCall{}
+	}
+
+	return f.calls[len(f.calls)-1]
+}
+
+// callsOf `fn` received so far
+func (f *fakeKDB) callsOf(fn string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+
+	for _, c := range f.calls {
+		if c.fn == fn {
+			n++
+		}
+	}
+
+	return n
+}
+
+// close stops accepting connections and drops open ones, like a killed q
+func (f *fakeKDB) close() {
+	f.ln.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range f.conns {
+		c.Close()
+	}
+}
+
+// fakeRollup is a partial rollup row of a bucket, as sent by `.P.tp_save`
+type fakeRollup struct {
+	ts   int64
+	lts  int64
+	lval []float64
+	// last values of typed tags
+	ltyped []interface{}
+}
+
+// fakeStore is a shard's data in memory, shared by its fake tp and hdb like
+// their /tmp/db, implementing `.P` functions the app calls. rows are
+// visible to hdb right away, as if tp flushed after each batch
+type fakeStore struct {
+	mu   sync.Mutex
+	rows map[string]Samples
+	// partial rollups of tags, by tier
+	rollups map[string]map[string][]fakeRollup
+	// last batch saved from each source, like tp's journal
+	seqs map[string]int64
+	// hdb watermark, tp's now if 0, since rows are visible right away
+	visible int64
+	// offset of tp's and hdb's clock from the app's
+	skew time.Duration
+	// rows written after newer ones of their tag, see `.P.tag_writes`
+	late []fakeLate
+	// `.P.tp_save` calls to drop the connection of, before or after saving
+	// the batch, like tp crashing
+	dropBefore, dropAfter int
+	// `.P.tp_save` calls wait for it to be closed, if it's set, like a hung tp
+	hang chan struct{}
+}
+
+// fakeLate is a row written at `wm` after a newer one of its tag
+type fakeLate struct {
+	wm  int64
+	tag string
+	ts  int64
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{rows: make(map[string]Samples), rollups: make(map[string]map[string][]fakeRollup), seqs: make(map[string]int64)}
+}
+
+// now on tp's clock
+func (s *fakeStore) now() int64 {
+	return time.Now().Add(s.skew).UnixNano()
+}
+
+// samples of a tag, sorted by time
+func (s *fakeStore) samples(tag string) Samples {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append(Samples(nil), s.rows[tag]...)
+}
+
+// count of rows of all tags
+func (s *fakeStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+
+	for _, rows := range s.rows {
+		n += len(rows)
+	}
+
+	return n
+}
+
+func (s *fakeStore) call(c fakeCall) (*kdb.K, error) {
+	s.mu.Lock()
+	hang := s.hang
+	s.mu.Unlock()
+
+	if hang != nil && c.fn == ".P.tp_save" {
+		<-hang
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch c.fn {
+	case "1b":
+		return &kdb.K{Type: -kdb.KB, Attr: kdb.NONE, Data: true}, nil
+	case ".P.tp_add":
+		return kdb.NewList(), s.add(c.args[0])
+	case ".P.visible_until[]":
+		if s.visible == 0 {
+			return kdb.Long(s.now()), nil
+		}
+
+		return kdb.Long(s.visible), nil
+	case ".P.tag_writes":
+		tag, since := c.args[0].Data.(string), c.args[1].Data.(int64)
+		w := []int64{s.visible, 0, 0}
+
+		if w[0] == 0 {
+			w[0] = time.Now().UnixNano()
+		}
+
+		if r := s.rows[tag]; len(r) > 0 {
+			w[1] = r[len(r)-1].Time
+		}
+
+		for _, l := range s.late {
+			if l.tag == tag && l.wm > since && (w[2] == 0 || l.ts < w[2]) {
+				w[2] = l.ts
+			}
+		}
+
+		return kdb.Atom(kdb.KJ, w), nil
+	case ".P.last_seq":
+		return kdb.Long(s.seqs[c.args[0].Data.(string)]), nil
+	case ".P.seq_at":
+		return kdb.Atom(kdb.KJ, []int64{s.seqs[c.args[0].Data.(string)], s.now()}), nil
+	case ".P.tp_save":
+		src, seq := c.args[0].Data.(string), c.args[1].Data.(int64)
+
+		if seq <= s.seqs[src] {
+			return kdb.Atom(kdb.KJ, []int64{s.seqs[src], s.now()}), nil
+		}
+
+		if s.dropBefore > 0 {
+			s.dropBefore--
+			return nil, errFakeDrop
+		}
+
+		if err := s.add(c.args[2]); err != nil {
+			return nil, err
+		}
+
+		s.seqs[src] = seq
+
+		for i, rows := range c.args[3].Data.([]*kdb.K) {
+			for _, row := range rows.Data.([]*kdb.K) {
+				cols := row.Data.([]*kdb.K)
+				tag := cols[0].Data.(string)
+				vals, typed, _ := cellValues(cols[3])
+
+				if s.rollups[tiers[i].name] == nil {
+					s.rollups[tiers[i].name] = make(map[string][]fakeRollup)
+				}
+
+				s.rollups[tiers[i].name][tag] = append(s.rollups[tiers[i].name][tag], fakeRollup{cols[1].Data.(int64), cols[2].Data.(int64), vals, typed})
+			}
+		}
+
+		if s.dropAfter > 0 {
+			s.dropAfter--
+			return nil, errFakeDrop
+		}
+
+		return kdb.Atom(kdb.KJ, []int64{seq, s.now()}), nil
+	case ".P.tp_upsert[]":
+		return kdb.Long(s.now()), nil
+	case ".P.sample_tag":
+		tag, lo, points := sampleArgs(c.args)
+
+		return sampleTable(points, s.after(tag, lo)), nil
+	case ".P.sample_rollup":
+		tier := c.args[0].Data.(string)
+		tag, lo, points := sampleArgs(c.args[1:])
+
+		return sampleTable(points, s.mergedRollups(tier, tag, lo)), nil
+	case ".P.export_tag", ".P.last_tag":
+		tag, start, end := seriesArgs(c.args)
+
+		var rows Samples
+
+		for _, r := range s.rows[tag] {
+			if r.Time > start && r.Time <= end {
+				rows = append(rows, r)
+			}
+		}
+
+		if c.fn == ".P.last_tag" && len(rows) > 0 {
+			rows = rows[len(rows)-1:]
+		}
+
+		return fakeTable(rows), nil
+	case ".P.list_tags[]":
+		var tags []string
+
+		for tag := range s.rows {
+			tags = append(tags, tag)
+		}
+
+		sort.Strings(tags)
+
+		return kdb.SymbolV(tags), nil
+	case ".P.date_tags[]":
+		day := int64(24 * time.Hour)
+		byDay := make(map[int64]map[string]bool)
+
+		for tag, rows := range s.rows {
+			for _, r := range rows {
+				d := bucketOf(r.Time, day) / day
+
+				if byDay[d] == nil {
+					byDay[d] = make(map[string]bool)
+				}
+
+				byDay[d][tag] = true
+			}
+		}
+
+		var days []int64
+
+		for d := range byDay {
+			days = append(days, d)
+		}
+
+		sort.Slice(days, func(i, j int) bool { return days[i] < days[j] })
+
+		tags := make([]*kdb.K, len(days))
+
+		for i, d := range days {
+			var list []string
+
+			for tag := range byDay[d] {
+				list = append(list, tag)
+			}
+
+			sort.Strings(list)
+			tags[i] = kdb.SymbolV(list)
+		}
+
+		return kdb.NewTable([]string{"day", "tags"}, []*kdb.K{kdb.Atom(kdb.KJ, days), kdb.NewList(tags...)}), nil
+	case ".P.drop_date", ".P.prune_tag":
+		day := int64(24 * time.Hour)
+		d := c.args[0].Data.(int64)
+		n := 0
+
+		// `.P.prune_tag` only drops rows of listed tags
+		dropped := func(tag string) bool { return true }
+
+		if c.fn == ".P.prune_tag" {
+			dropped = func(tag string) bool { return indexOf(c.args[1].Data.([]string), tag) >= 0 }
+		}
+
+		for tag, rows := range s.rows {
+			if !dropped(tag) {
+				continue
+			}
+
+			var kept Samples
+
+			for _, r := range rows {
+				if bucketOf(r.Time, day)/day != d {
+					kept = append(kept, r)
+				}
+			}
+
+			n += len(rows) - len(kept)
+			s.rows[tag] = kept
+
+			if len(kept) == 0 {
+				delete(s.rows, tag)
+			}
+		}
+
+		for _, byTag := range s.rollups {
+			for tag, rs := range byTag {
+				if !dropped(tag) {
+					continue
+				}
+
+				var kept []fakeRollup
+
+				for _, r := range rs {
+					if bucketOf(r.ts, day)/day != d {
+						kept = append(kept, r)
+					}
+				}
+
+				byTag[tag] = kept
+			}
+		}
+
+		return kdb.Long(int64(n)), nil
+	case ".P.drop_tag":
+		tag := c.args[0].Data.(string)
+		n := len(s.rows[tag])
+
+		delete(s.rows, tag)
+
+		for _, byTag := range s.rollups {
+			delete(byTag, tag)
+		}
+
+		return kdb.Long(int64(n)), nil
+	case ".P.backfill_tag":
+		tag := c.args[0].Data.(string)
+		rows := s.rows[tag]
+
+		for _, t := range tiers {
+			var rs []fakeRollup
+
+			for _, r := range rows {
+				b := bucketOf(r.Time, int64(t.width))
+
+				if len(rs) == 0 || rs[len(rs)-1].ts != b {
+					rs = append(rs, fakeRollup{ts: b})
+				}
+
+				rs[len(rs)-1].lts, rs[len(rs)-1].lval, rs[len(rs)-1].ltyped = r.Time, r.Values, r.Typed
+			}
+
+			if s.rollups[t.name] == nil {
+				s.rollups[t.name] = make(map[string][]fakeRollup)
+			}
+
+			s.rollups[t.name][tag] = rs
+		}
+
+		return kdb.Long(int64(len(rows))), nil
+	}
+
+	// q's error for an undefined name
+	return nil, fmt.Errorf("%s", c.fn)
+}
+
+// add `(tag; ts; values)` rows, keeping each tag's rows sorted
+func (s *fakeStore) add(rows *kdb.K) error {
+	list, ok := rows.Data.([]*kdb.K)
+
+	if !ok {
+		return fmt.Errorf("type")
+	}
+
+	for _, row := range list {
+		cols := row.Data.([]*kdb.K)
+		tag, ts := cols[0].Data.(string), cols[1].Data.(int64)
+		vals, typed, _ := cellValues(cols[2])
+
+		r := s.rows[tag]
+		i := sort.Search(len(r), func(i int) bool { return r[i].Time > ts })
+
+		if i < len(r) {
+			s.late = append(s.late, fakeLate{time.Now().UnixNano(), tag, ts})
+		}
+
+		r = append(r, sample{})
+		copy(r[i+1:], r[i:])
+		r[i] = sample{ts, vals, typed}
+
+		s.rows[tag] = r
+	}
+
+	return nil
+}
+
+// seriesArgs are `(tag; start; end; dates)` arguments
+func seriesArgs(args []*kdb.K) (string, int64, int64) {
+	return args[0].Data.(string), args[1].Data.(int64), args[2].Data.(int64)
+}
+
+// sampleArgs are `(tag; lo; points; dates)` arguments of `.P.sample_*`
+func sampleArgs(args []*kdb.K) (string, int64, []int64) {
+	return args[0].Data.(string), args[1].Data.(int64), args[2].Data.([]int64)
+}
+
+// after are rows of a tag after `lo`, as points of their own time
+func (s *fakeStore) after(tag string, lo int64) []pointSample {
+	var rows []pointSample
+
+	for _, r := range s.rows[tag] {
+		if r.Time > lo {
+			rows = append(rows, pointSample{r.Time, r.Time, r.Values, r.Typed})
+		}
+	}
+
+	return rows
+}
+
+// mergedRollups of a tag's buckets starting after `lo`, like
+// `.P.merge_rollup`, as points at the time of their newest raw row, from
+// the bucket's start, sorted by it
+func (s *fakeStore) mergedRollups(tier string, tag string, lo int64) []pointSample {
+	byBucket := make(map[int64]fakeRollup)
+
+	for _, r := range s.rollups[tier][tag] {
+		if m, ok := byBucket[r.ts]; r.ts > lo && (!ok || r.lts >= m.lts) {
+			byBucket[r.ts] = r
+		}
+	}
+
+	var rows []pointSample
+
+	for _, r := range byBucket {
+		rows = append(rows, pointSample{r.lts, r.ts, r.lval, r.ltyped})
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].time < rows[j].time })
+
+	return rows
+}
+
+// sampleTable is `aj` of `points` with `rows`, a `ts`, `src`, `val` table
+// with null `src` and empty lists for points without values
+func sampleTable(points []int64, rows []pointSample) *kdb.K {
+	src := make([]int64, len(points))
+	vals := make([]*kdb.K, len(points))
+
+	for i, p := range points {
+		n := sort.Search(len(rows), func(j int) bool { return rows[j].time > p })
+
+		src[i] = math.MinInt64
+		vals[i] = kdb.NewList()
+
+		if n > 0 {
+			src[i] = rows[n-1].src
+			vals[i] = valuesK(rows[n-1].values, rows[n-1].typed)
+		}
+	}
+
+	return kdb.NewTable([]string{"ts", "src", "val"}, []*kdb.K{kdb.Atom(kdb.KJ, append([]int64(nil), points...)), kdb.Atom(kdb.KJ, src), kdb.NewList(vals...)})
+}
+
+// fakeTable is a `ts`, `val` table of samples, empty lists for ones
+// without values, like q's nulls of a nested column
+func fakeTable(rows Samples) *kdb.K {
+	ts := make([]int64, len(rows))
+	vals := make([]*kdb.K, len(rows))
+
+	for i, r := range rows {
+		ts[i] = r.Time
+		vals[i] = kdb.NewList()
+
+		if r.Values != nil || r.Typed != nil {
+			vals[i] = valuesK(r.Values, r.Typed)
+		}
+	}
+
+	return kdb.NewTable([]string{"ts", "val"}, []*kdb.K{kdb.Atom(kdb.KJ, ts), kdb.NewList(vals...)})
+}
+
+// fakeShard is a fake tp and hdb, sharing a store
+type fakeShard struct {
+	tp    *fakeKDB
+	hdb   *fakeKDB
+	store *fakeStore
+}
+
+// getFakeKDB starts a fake shard for each of `names`, and connects to them
+// with newKDB, like getKDB does to configured ones
+func getFakeKDB(t testing.TB, names ...string) (KDB, map[string]*fakeShard) {
+	shards := make(map[string]*fakeShard)
+
+	var configs []shardConfig
+
+	for _, name := range names {
+		store := newFakeStore()
+		s := &fakeShard{newFakeKDB(t, store.call), newFakeKDB(t, store.call), store}
+
+		shards[name] = s
+		configs = append(configs, shardConfig{Name: name, TP: s.tp.addr(), HDB: s.hdb.addr()})
+	}
+
+	return newKDB(configs), shards
+}
+
+// waitRows waits for `n` rows in the store, fails after 5s
+func (s *fakeStore) waitRows(t testing.TB, n int) {
+	for i := 0; i < 500; i++ {
+		if s.count() >= n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d rows, got %d", n, s.count())
+}
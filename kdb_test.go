@@ -3,10 +3,18 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
 )
 
 func kdbInit() Database {
@@ -125,87 +133,26 @@ func TestTableRW(t *testing.T) {
 */
 
 func TestBatchSave(t *testing.T) {
-	t.Skip("integration")
-	// db := getKDB()
-	// in := db.startQueueConsumer()
-	td := getTestServer()
-	amt := 1000000
-	/*
-		go func() {
-			s := &fasthttp.Server{
-				Handler: fhMux(db, in),
-			}
-
-			ln := fasthttputil.NewInmemoryListener()
-
-			if err := s.Serve(ln); err != nil {
-				t.Fatalf("unexpected error: %s", err)
-			}
-		}()
-	*/
-	/*
-		router := gin.New()
-		gin.SetMode(gin.ReleaseMode)
-		router.POST("/save", saveHandler(in))
-	*/
-	s := time.Now()
+	td := getTestServer(t)
+	amt := 10000
 
 	for i := 0; i < amt; i++ {
-		tag := fmt.Sprintf("t%d", rand.Intn(10000))
-
-		values := []float64{rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(),
-			rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64()}
-
-		td.in <- Msg{time.Now().UnixNano(), tag, values}
-
+		td.in <- randMsg(time.Now().UnixNano(), fmt.Sprintf("t%d", rand.Intn(100)))
 	}
-	/*
-		go func() {
-			w := httptest.NewRecorder()
-
-			for i := 0; i < amt/2; i++ {
-				tag := fmt.Sprintf("t%d", rand.Intn(10000))
-
-				values := []float64{rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(),
-					rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64()}
-
-				jsonMsg, _ := json.Marshal(Msg{time.Now(), tag, values})
-
-				req, err := http.NewRequest("POST", "/save", bytes.NewReader(jsonMsg))
 
-				if err != nil {
-					fmt.Printf("!> error creating request", err)
-					return
-				}
+	td.shard.store.waitRows(t, amt)
 
-				router.ServeHTTP(w, req)
-			}
+	assert.Equal(t, amt, td.shard.store.count(), "each message should be saved once")
 
-		}()
-
-		w := httptest.NewRecorder()
-
-		for i := amt / 2; i < amt; i++ {
-			tag := fmt.Sprintf("t%d", rand.Intn(10000))
-
-			values := []float64{rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(),
-				rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64(), rand.Float64()}
+	for i := 0; i < 100; i++ {
+		tag := fmt.Sprintf("t%d", i)
 
-			jsonMsg, _ := json.Marshal(Msg{time.Now(), tag, values})
-
-			req, err := http.NewRequest("POST", "/save", bytes.NewReader(jsonMsg))
-
-			if err != nil {
-				fmt.Printf("!> error creating request", err)
-				return
-			}
-
-			router.ServeHTTP(w, req)
+		for _, s := range td.shard.store.samples(tag) {
+			assert.Equal(t, randMsg(s.Time, tag).Values, s.Values, "values should be saved with their ts")
 		}
-	*/
-	log.Printf("> %v sent all Msg\n", time.Now().Sub(s))
+	}
 
-	time.Sleep(1 * time.Second)
+	assert.NotZero(t, td.shard.tp.callsOf(".P.tp_save"), "batches should be sent to tp")
 }
 
 /*
@@ -218,7 +165,7 @@ func TestOutQueue(t *testing.T) {
 	gin.SetMode(gin.ReleaseMode)
 	router.POST("/save", saveHandler(in))
 
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 	fmt.Printf("> %q\n", jsonMsg)
 
 	s := time.Now()
@@ -287,3 +234,242 @@ func TestOutQueue(t *testing.T) {
 
 }
 */
+
+func TestLatenessWindow(t *testing.T) {
+	late := newLateness(time.Second)
+
+	now := time.Now().UnixNano()
+
+	accepted := []bool{
+		late.accept(Msg{now, "t1", nil, nil}),
+		late.accept(Msg{now - time.Second.Nanoseconds()/2, "t1", nil, nil}),
+		late.accept(Msg{now - 2*time.Second.Nanoseconds(), "t1", nil, nil}),
+		late.accept(Msg{now - 2*time.Second.Nanoseconds(), "t2", nil, nil}),
+	}
+
+	assert.Equal(t, []bool{true, true, false, true}, accepted, "only messages older than window should be rejected")
+}
+
+func TestRowsSortedByTs(t *testing.T) {
+	var rows []*kdb.K
+
+	for _, ts := range []int64{30, 10, 20, 10} {
+		rows = append(rows, kdb.NewList(kdb.Symbol("t1"), kdb.Long(ts), kdb.Atom(kdb.KF, []float64{float64(ts)})))
+	}
+
+	sort.Stable(kdbRows(rows))
+
+	var got []int64
+
+	for _, r := range rows {
+		got = append(got, rowTs(r))
+	}
+
+	assert.Equal(t, []int64{10, 10, 20, 30}, got, "batch should be sorted by ts")
+}
+
+func TestQDates(t *testing.T) {
+	start := time.Date(2017, 5, 1, 23, 30, 0, 0, time.UTC).UnixNano()
+
+	// 2017.05.01 is 6330 days from 2000.01.01
+	assert.Equal(t, []int32{6330, 6330}, qDates(start, start+int64(time.Minute)).Data)
+	assert.Equal(t, []int32{6330, 6331}, qDates(start, start+int64(time.Hour)).Data, "interval should span both partitions")
+	assert.Equal(t, []int32{-qEpochDays - 1, -qEpochDays}, qDates(-1, 0).Data, "dates before 1970 should be rounded down")
+}
+
+// a tag reporting less than daily has values from before the day before
+// the series, while hdb is only asked for partitions from that day on
+func TestSampleLooksBackPastPartitions(t *testing.T) {
+	db, shards := getFakeKDB(t, "default")
+	store := shards["default"].store
+
+	end := time.Date(2017, 5, 4, 12, 0, 0, 0, time.UTC).UnixNano()
+	start := end - int64(time.Minute)
+	at := time.Date(2017, 5, 1, 6, 0, 0, 0, time.UTC).UnixNano()
+
+	store.mu.Lock()
+	store.rows["t1"] = Samples{{at, []float64{1}, nil}}
+	store.mu.Unlock()
+
+	res, err := db.getSeries("t1", start, end)
+
+	assert.NoError(t, err)
+	assert.Len(t, res.Samples, 100, "points should have the tag's last value")
+	assert.Equal(t, []float64{1}, res.Samples[0].Values)
+
+	call := shards["default"].hdb.lastCall()
+
+	assert.Equal(t, ".P.sample_tag", call.fn)
+	dates := []time.Time{time.Date(2017, 5, 3, 0, 0, 0, 0, time.UTC), time.Date(2017, 5, 4, 0, 0, 0, 0, time.UTC)}
+	assert.Equal(t, dates, call.args[3].Data, "only the day before the series should be mapped")
+}
+
+// hostile tags reach hdb as symbol arguments of a fixed function, never as
+// q source
+func FuzzAPITag(f *testing.F) {
+	db, shards := getFakeKDB(f, "default")
+	hdb := shards["default"].hdb
+
+	c := getServer(db, newIntake(make(chan Msg, 1)), nil, nil, nil, nil).c
+
+	for _, tag := range []string{"t1", "a`b", "t1;.Q.hdpf[]", "t1] ; system\"rm -rf /\"; [", "a b", "`$\"x\"", "\n", "", "\x00", "acme:t1", "\xff\xfe", "тег"} {
+		f.Add(tag, false)
+		f.Add(tag, true)
+	}
+
+	f.Fuzz(func(t *testing.T, tag string, raw bool) {
+		if len(tag) > 1024 {
+			t.Skip("request line would be too long")
+		}
+
+		end := time.Now().UnixNano()
+		start := end - int64(time.Hour)
+
+		if raw {
+			start = end - int64(time.Minute)
+		}
+
+		args := url.Values{"tag": {tag}, "start": {fmt.Sprint(start)}, "end": {fmt.Sprint(end)}}
+
+		status, _, err := c.GetTimeout(nil, "http://test.me/api?"+args.Encode(), time.Second)
+
+		assert.NoError(t, err)
+
+		if !validTag(tag) {
+			assert.Equal(t, 400, status, "invalid tags should be rejected")
+			return
+		}
+
+		assert.Equal(t, 200, status)
+
+		call := hdb.lastCall()
+
+		if raw {
+			assert.Equal(t, ".P.sample_tag", call.fn)
+			assert.Equal(t, tag, call.args[0].Data, "tag should be sent as is")
+		} else {
+			assert.Equal(t, ".P.sample_rollup", call.fn)
+			assert.Equal(t, tag, call.args[1].Data, "tag should be sent as is")
+		}
+	})
+}
+
+func TestVisibleWatermark(t *testing.T) {
+	td := getTestServer(t)
+	store := td.shard.store
+
+	code, body, _ := td.c.Get(nil, "http://test.me/health/ready")
+
+	assert.Equal(t, 200, code, "fresh watermark should be ready: %s", body)
+
+	// hdb doesn't see new batches
+	store.mu.Lock()
+	store.visible = time.Now().Add(-time.Minute).UnixNano()
+	store.mu.Unlock()
+
+	code, body, _ = td.c.Get(nil, "http://test.me/health/ready")
+
+	assert.Equal(t, 503, code, "stale watermark should fail readiness")
+	assert.Contains(t, string(body), "rows of shard0 are visible up to")
+
+	td.in <- randMsg(time.Now().UnixNano(), "t1")
+	accepted := time.Now().UnixNano()
+
+	store.waitRows(t, 1)
+
+	end := time.Now().UnixNano()
+
+	assert.True(t, td.getData(t, end-int64(time.Hour), end, "t1").VisibleUntil < accepted, "acknowledged batch isn't visible before hdb sees it")
+
+	store.mu.Lock()
+	store.visible = 0
+	store.mu.Unlock()
+
+	time.Sleep(2 * conf.Batch.MaxAge / 10)
+
+	assert.True(t, td.getData(t, end-int64(time.Hour), end, "t1").VisibleUntil >= accepted, "the message should be visible, once hdb sees its batch")
+}
+
+// ingest lag is observed once hdb sees a batch, and only batched messages
+// are accepted
+func TestIngestLagOnceVisible(t *testing.T) {
+	td := getTestServer(t)
+	store := td.shard.store
+
+	// hdb doesn't see new batches
+	store.mu.Lock()
+	store.visible = time.Now().Add(-time.Minute).UnixNano()
+	store.mu.Unlock()
+
+	observed, accepted, late := atomic.LoadUint64(&ingestLag.count), msgAccepted.get(), msgRejected.get("late")
+	now := time.Now().UnixNano()
+
+	td.in <- randMsg(now, "lag")
+	td.in <- randMsg(now-2*int64(conf.Batch.LateWindow), "lag")
+
+	store.waitRows(t, 1)
+	time.Sleep(3 * visiblePoll)
+
+	assert.Equal(t, accepted+1, msgAccepted.get(), "late messages shouldn't be accepted")
+	assert.Equal(t, late+1, msgRejected.get("late"))
+	assert.Equal(t, observed, atomic.LoadUint64(&ingestLag.count), "lag shouldn't be observed before hdb sees the batch")
+
+	store.mu.Lock()
+	store.visible = 0
+	store.mu.Unlock()
+
+	for i := 0; i < 100 && atomic.LoadUint64(&ingestLag.count) == observed; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, observed+1, atomic.LoadUint64(&ingestLag.count), "lag should be observed once hdb sees the batch")
+}
+
+func TestVisibleOnTPClock(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0")
+	store := shards["shard0"].store
+
+	// tp and hdb clocks are behind the app's
+	store.mu.Lock()
+	store.skew = -time.Hour
+	store.mu.Unlock()
+
+	in := db.startQueueConsumer()
+	defer close(in)
+
+	in <- Msg{1000, "a", []float64{1}, nil}
+	accepted := time.Now().UnixNano()
+
+	store.waitRows(t, 1)
+
+	s := time.Now()
+	db.waitVisible("a", accepted, 5*time.Second)
+
+	assert.True(t, time.Since(s) < 5*time.Second, "batches should be acknowledged on tp's clock")
+
+	v, err := db.visibleUntil("a")
+
+	assert.NoError(t, err)
+	assert.True(t, v >= accepted, "the message should be visible, once hdb sees its batch")
+}
+
+func TestWaitVisibleSharesPolls(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0")
+	hdb := shards["shard0"].hdb
+	calls := hdb.callsOf(".P.visible_until[]")
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			db.waitVisible("a", math.MaxInt64, 10*visiblePoll)
+		}()
+	}
+
+	wg.Wait()
+
+	assert.True(t, hdb.callsOf(".P.visible_until[]")-calls <= 12, "waiters should share polls of the shard's watermark")
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -36,7 +35,7 @@ func postWorker(messages <-chan Msg, wg *sync.WaitGroup, urls string) {
 	u, err := url.Parse(urls)
 
 	if err != nil {
-		log.Fatal(err)
+		logger.fatal("can't parse url", "url", urls, "error", err)
 	}
 
 	c := &fasthttp.PipelineClient{
@@ -47,7 +46,7 @@ func postWorker(messages <-chan Msg, wg *sync.WaitGroup, urls string) {
 
 	go func() {
 		for {
-			log.Printf("> post worker pending requests: %d", c.PendingRequests())
+			logger.debug("post worker", "pending", c.PendingRequests())
 			time.Sleep(time.Second)
 		}
 	}()
@@ -62,7 +61,6 @@ func postWorker(messages <-chan Msg, wg *sync.WaitGroup, urls string) {
 			req.Header.SetMethod("POST")
 			req.SetRequestURI(urls)
 			// resp := fasthttp.AcquireResponse()
-			// log.Println("> postWorker url: ", url)
 
 			// resp := fasthttp.AcquireResponse()
 
@@ -73,26 +71,25 @@ func postWorker(messages <-chan Msg, wg *sync.WaitGroup, urls string) {
 			err := c.Do(req, nil)
 
 			if err != nil {
-				log.Printf("> pending requests: %d", c.PendingRequests())
-				log.Fatalf("!> sendPostMessage error: %v\n", err)
+				logger.fatal("sendPostMessage failed", "pending", c.PendingRequests(), "error", err)
 			}
 
 		}()
 	}
 
 	for c.PendingRequests() > 0 {
-		log.Printf("> mesages done, sleeping while pending requests: %d", c.PendingRequests())
+		logger.every("postWorker.pending", time.Second).info("messages done, waiting for pending requests", "pending", c.PendingRequests())
 		time.Sleep(50 * time.Millisecond)
 	}
 
 	time.Sleep(50 * time.Millisecond)
 
-	log.Printf("> post worker closed messages: %d, done witn requests: %v\n", len(messages), c)
+	logger.info("post worker done", "messages", len(messages))
 }
 
 func newHTTPLoader(url string, numTags int) HTTPLoader {
 	if url == "" {
-		log.Fatal("! empty url for HTTPLoader")
+		logger.fatal("empty url for HTTPLoader")
 	}
 
 	postMessages := make(chan Msg, 200000)
@@ -107,7 +104,7 @@ func newHTTPLoader(url string, numTags int) HTTPLoader {
 		go postWorker(postMessages, &wg, url)
 	}
 
-	fmt.Printf("> %v, \t added %d 'msgQueue -> POST' workers \n", time.Now(), numPostWorkers)
+	logger.info("added 'msgQueue -> POST' workers", "workers", numPostWorkers)
 
 	return HTTPLoader{url, &wg, postMessages, 0, numTags, time.Hour * 24}
 }
@@ -124,7 +121,7 @@ func (l *HTTPLoader) add(amt int) time.Duration {
 
 	l.counter += amt
 
-	fmt.Printf("> %v, \t %v \t HTTPLoader.add()ed %d messages, queue %d\n", time.Now(), doneIn, amt, len(l.messages))
+	logger.info("HTTPLoader.add()ed messages", "batch", amt, "duration", doneIn, "queue", len(l.messages))
 
 	return doneIn
 }
@@ -136,7 +133,7 @@ func (l *HTTPLoader) addOne() Msg {
 
 	l.counter++
 
-	log.Printf("> %v added to loader", m)
+	logger.debug("added to loader", "tag", m.Tag, "time", m.Time)
 
 	return m
 }
@@ -144,25 +141,23 @@ func (l *HTTPLoader) addOne() Msg {
 func (l HTTPLoader) stop() {
 	close(l.messages)
 
-	log.Printf("> %v \t stopping loader, closed messages chan\n", time.Now())
+	logger.info("stopping loader, closed messages chan")
 
 	l.workers.Wait()
 
-	log.Printf("> %v \t all workers done\n", time.Now())
+	logger.info("all loader workers done")
 }
 
 func sendPostMessage(url string, msg Msg) {
-	// fmt.Println("> sending message to url: ", url, msg)
 	messageJSON, _ := easyjson.Marshal(msg)
 
 	resp, err := http.Post(url, "application/json; charset=utf-8", bytes.NewBuffer(messageJSON))
 
 	if err != nil {
-		fmt.Println(err)
+		logger.error("sendPostMessage failed", "url", url, "error", err)
+		return
 	}
 
-	// log.Printf("> post worker sent %v to %v", msg, url)
-
 	io.Copy(ioutil.Discard, resp.Body)
 	resp.Body.Close()
 }
@@ -202,13 +197,13 @@ func apiResponseTimes(url string, start int64, end int64, numTags int, stats map
 		_, err := getData(url+"/api", start, end, tag)
 
 		if err != nil {
-			fmt.Println("!> expected API response for: ", url+"/api", tag, start, end)
+			logger.error("expected API response", "url", url+"/api", "tag", tag, "start", start, "end", end, "error", err)
 			return
 		}
 
 		callEnd := time.Now().Sub(callStart)
 
-		fmt.Printf("> API responded in: %v\n", callEnd)
+		logger.info("API responded", "tag", tag, "duration", callEnd)
 
 		responseTimes <- callEnd
 	}
@@ -235,21 +230,29 @@ func apiResponseTimes(url string, start int64, end int64, numTags int, stats map
 }
 
 func getData(url string, start int64, end int64, tag string) (APIResponse, error) {
-	var data APIResponse
+	return getURL(fmt.Sprintf("%s?start=%d&end=%d&tag=%s", url, start, end, tag))
+}
 
-	fullURL := fmt.Sprintf("%s?start=%d&end=%d&tag=%s", url, start, end, tag)
+// waitData gets data, once messages accepted before `waitFor` are visible,
+// or after `timeout`
+func waitData(url string, start int64, end int64, tag string, waitFor int64, timeout time.Duration) (APIResponse, error) {
+	return getURL(fmt.Sprintf("%s?start=%d&end=%d&tag=%s&waitFor=%d&timeout=%v", url, start, end, tag, waitFor, timeout))
+}
+
+func getURL(fullURL string) (APIResponse, error) {
+	var data APIResponse
 
 	c := &fasthttp.Client{}
 
 	code, body, err := c.Get(nil, fullURL)
 
 	if err != nil || code != 200 {
-		log.Fatalf("!> error getting API response from %v, %v, %v, %v ", fullURL, start, end, tag)
+		logger.fatal("can't get API response", "url", fullURL, "code", code, "error", err)
 		return data, err
 	}
 
 	if err := json.Unmarshal(body, &data); err != nil {
-		log.Printf("!> error unmarshalling API response body to JSON: %s", body)
+		logger.error("can't unmarshal API response", "body", string(body), "error", err)
 		return data, err
 	}
 
@@ -259,5 +262,5 @@ func getData(url string, start int64, end int64, tag string) (APIResponse, error
 func randMsg(t int64, tag string) Msg {
 	v := float64(t) / 10e12
 
-	return Msg{t, tag, []float64{v, v, v, v, v, v, v, v, v, v}}
+	return Msg{t, tag, []float64{v, v, v, v, v, v, v, v, v, v}, nil}
 }
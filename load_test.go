@@ -1,17 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/valyala/fasthttp"
-	"github.com/valyala/fasthttp/fasthttputil"
 )
 
 func TestInsertSpeed(t *testing.T) {
@@ -80,9 +81,7 @@ func Test2sLag(t *testing.T) {
 	for i := 0.0; i < duration.Seconds(); i++ {
 		elapsed := loader.add(rate)
 
-		m := loader.addOne()
-
-		go checkMessageReadable(url, m, t)
+		go checkMessageReadable(url, fmt.Sprintf("t%d", rand.Intn(numTags)), t)
 
 		go apiResponseTimes(url, start, end, numTags, stats)
 
@@ -115,18 +114,25 @@ func Test2sLag(t *testing.T) {
 	fmt.Println("finished 1K 2second lag test")
 }
 
-func checkMessageReadable(url string, m Msg, t *testing.T) {
-	// fmt.Println("> asking for written message: ", url, m)
-	<-time.After(time.Second * 2)
+// checkMessageReadable saves a message, and expects it to be visible in 2s
+func checkMessageReadable(url string, tag string, t *testing.T) {
+	m := randMsg(time.Now().UnixNano(), tag)
+
+	sendPostMessage(url+"/save", m)
 
+	accepted := time.Now().UnixNano()
 	start := m.Time - time.Duration(10*time.Minute).Nanoseconds()
 
-	res, _ := getData(url+"/api", start, m.Time, m.Tag)
+	res, _ := waitData(url+"/api", start, m.Time, m.Tag, accepted, 2*time.Second)
 
-	// fmt.Println("> got samples: ", len(res.Samples))
+	if res.VisibleUntil < accepted {
+		t.Errorf("!> message isn't visible in 2s: %s/api?tag=%v&start=%d&end=%d\n", url, m.Tag, start, m.Time)
+		return
+	}
 
 	if len(res.Samples) == 0 {
-		t.Fatal("!> expected samples in response!")
+		t.Error("!> expected samples in response!")
+		return
 	}
 
 	if reflect.DeepEqual(res.Samples[len(res.Samples)-1].Values, m.Values) {
@@ -145,6 +151,8 @@ type testData struct {
 	c  *fasthttp.Client
 	db Database
 	in chan Msg
+	// shard behind db of getTestServer
+	shard *fakeShard
 }
 
 func (td testData) stop() {
@@ -156,35 +164,46 @@ func (td testData) stop() {
 }
 
 func (td testData) saveURL() string {
-	return fmt.Sprintf("%s://%s/save", td.ln.Addr().Network, td.ln.Addr().String())
+	return fmt.Sprintf("%s://%s/save", td.ln.Addr().Network(), td.ln.Addr().String())
 }
 
 func (td testData) apiURL() string {
-	return fmt.Sprintf("%s://%s/api", td.ln.Addr().Network, td.ln.Addr().String())
+	return fmt.Sprintf("%s://%s/api", td.ln.Addr().Network(), td.ln.Addr().String())
 }
 
-func getTestServer() testData {
-	db := getDB("test")
+// getTestServer serves KDB, connected to a fake shard
+func getTestServer(t testing.TB) testData {
+	db, shards := getFakeKDB(t, "shard0")
 
-	in := db.startQueueConsumer()
+	td := getServer(withCache(db, conf.API.CacheBytes), newIntake(db.startQueueConsumer()), nil, nil, nil, nil)
+	td.db, td.shard = db, shards["shard0"]
 
-	s := &fasthttp.Server{
-		Handler: fhMux(db, in),
-	}
+	return td
+}
 
-	ln := fasthttputil.NewInmemoryListener()
+// get `path` of the test server, returns status and body
+func (td testData) get(path string) (int, string) {
+	return request(td.c, "GET", "http://test.me"+path, "", "")
+}
 
-	go func() {
-		if err := s.Serve(ln); err != nil {
-			log.Fatalf("unexpected error: %s", err)
-		}
-	}()
+// save posts a message to /save of the test server, returns status
+func (td testData) save(msg string) int {
+	return doWithKey(td.c, "POST", "http://test.me/save", "", msg)
+}
+
+// getData from /api of the test server, with `extra` args, like `waitFor=1`
+func (td testData) getData(t testing.TB, start int64, end int64, tag string, extra ...string) APIResponse {
+	var data APIResponse
+
+	status, body, err := td.c.Get(nil, fmt.Sprintf("http://test.me/api?start=%d&end=%d&tag=%s", start, end, tag)+strings.Join(append([]string{""}, extra...), "&"))
+
+	if err != nil || status != 200 {
+		t.Fatalf("can't get API response: %d %v %s", status, err, body)
+	}
 
-	c := &fasthttp.Client{
-		Dial: func(addr string) (net.Conn, error) {
-			return ln.Dial()
-		},
+	if err := json.Unmarshal(body, &data); err != nil {
+		t.Fatalf("can't unmarshal API response %s: %v", body, err)
 	}
 
-	return testData{s, ln, c, db, in}
+	return data
 }
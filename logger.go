@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("unknown log level %q, expected one of %v", s, levelNames)
+}
+
+// jsonLogger writes one JSON object per line: `ts`, `level`, `msg`, followed
+// by key-value fields. level is shared by all loggers derived with `with`,
+// and can be changed at runtime on `/admin/log`
+type jsonLogger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+type logOutput struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   int32
+	limitMu sync.Mutex
+	limits  map[string]*logLimit
+}
+
+// state of a rate limited log line, see `jsonLogger.every`
+type logLimit struct {
+	last       time.Time
+	suppressed int
+}
+
+var logger = newLogger(os.Stderr, levelInfo)
+
+func newLogger(w io.Writer, level logLevel) *jsonLogger {
+	return &jsonLogger{out: &logOutput{w: w, level: int32(level), limits: make(map[string]*logLimit)}}
+}
+
+func (l *jsonLogger) level() logLevel {
+	return logLevel(atomic.LoadInt32(&l.out.level))
+}
+
+func (l *jsonLogger) setLevel(level logLevel) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// with returns a logger adding `kv` fields to each line
+func (l *jsonLogger) with(kv ...interface{}) *jsonLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+
+	return &jsonLogger{l.out, append(append(fields, l.fields...), kv...)}
+}
+
+// every rate limits lines logged with the same `key` to one per `interval`.
+// returns nil when a line should be dropped, otherwise a logger that adds
+// the number of dropped lines since the last one as `suppressed`
+func (l *jsonLogger) every(key string, interval time.Duration) *jsonLogger {
+	l.out.limitMu.Lock()
+	defer l.out.limitMu.Unlock()
+
+	lim, ok := l.out.limits[key]
+
+	if !ok {
+		lim = &logLimit{}
+		l.out.limits[key] = lim
+	}
+
+	now := time.Now()
+
+	if now.Sub(lim.last) < interval {
+		lim.suppressed++
+		return nil
+	}
+
+	suppressed := lim.suppressed
+
+	lim.last = now
+	lim.suppressed = 0
+
+	if suppressed == 0 {
+		return l
+	}
+
+	return l.with("suppressed", suppressed)
+}
+
+func (l *jsonLogger) debug(msg string, kv ...interface{}) {
+	l.log(levelDebug, msg, kv)
+}
+
+func (l *jsonLogger) info(msg string, kv ...interface{}) {
+	l.log(levelInfo, msg, kv)
+}
+
+func (l *jsonLogger) warn(msg string, kv ...interface{}) {
+	l.log(levelWarn, msg, kv)
+}
+
+func (l *jsonLogger) error(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+}
+
+// fatal logs on error level and exits
+func (l *jsonLogger) fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *jsonLogger) log(level logLevel, msg string, kv []interface{}) {
+	if l == nil || level < l.level() {
+		return
+	}
+
+	buf := make([]byte, 0, 256)
+
+	buf = append(buf, `{"ts":`...)
+	buf = appendJSON(buf, time.Now().UTC().Format(time.RFC3339Nano))
+	buf = append(buf, `,"level":`...)
+	buf = appendJSON(buf, level.String())
+	buf = append(buf, `,"msg":`...)
+	buf = appendJSON(buf, msg)
+	buf = appendFields(buf, l.fields)
+	buf = appendFields(buf, kv)
+	buf = append(buf, "}\n"...)
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf)
+	l.out.mu.Unlock()
+}
+
+func appendFields(buf []byte, kv []interface{}) []byte {
+	for i := 0; i < len(kv); i += 2 {
+		var v interface{} = "(missing)"
+
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+
+		buf = append(buf, ',')
+		buf = appendJSON(buf, fmt.Sprint(kv[i]))
+		buf = append(buf, ':')
+		buf = appendJSON(buf, v)
+	}
+
+	return buf
+}
+
+func appendJSON(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case error:
+		return appendJSON(buf, v.Error())
+	case fmt.Stringer:
+		return appendJSON(buf, v.String())
+	}
+
+	b, err := json.Marshal(v)
+
+	if err != nil {
+		return appendJSON(buf, fmt.Sprint(v))
+	}
+
+	return append(buf, b...)
+}
+
+// `GET /admin/log` returns current level, `PUT /admin/log?level=<level>` sets it
+func logLevelHandler(ctx *fasthttp.RequestCtx) {
+	if ctx.IsPut() || ctx.IsPost() {
+		level, err := parseLevel(string(ctx.QueryArgs().Peek("level")))
+
+		if err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+
+		logger.setLevel(level)
+		logger.info("log level changed", "level", level)
+	}
+
+	ctx.SetContentType("application/json")
+	fmt.Fprintf(ctx, `{"level":%q}`, logger.level())
+}
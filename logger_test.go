@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggerJSONFields(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := newLogger(&buf, levelInfo)
+
+	l.debug("hidden")
+	l.with("tag", "t1").error("batch failed", "batch", 10, "duration", time.Second, "error", errors.New("boom"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	assert.Len(t, lines, 1, "debug line should be filtered out on info level")
+
+	var line map[string]interface{}
+
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("!> log line is not JSON: %s, %v", lines[0], err)
+	}
+
+	assert.Equal(t, "error", line["level"])
+	assert.Equal(t, "batch failed", line["msg"])
+	assert.Equal(t, "t1", line["tag"])
+	assert.Equal(t, float64(10), line["batch"])
+	assert.Equal(t, "1s", line["duration"])
+	assert.Equal(t, "boom", line["error"])
+}
+
+func TestLoggerEvery(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := newLogger(&buf, levelInfo)
+
+	for i := 0; i < 5; i++ {
+		l.every("batch", time.Hour).info("batch saved")
+	}
+
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "should log once per interval")
+
+	l.out.limits["batch"].last = time.Time{}
+	l.every("batch", time.Hour).info("batch saved")
+
+	assert.Contains(t, buf.String(), `"suppressed":4`, "should report suppressed lines")
+}
+
+func TestLogLevelAdmin(t *testing.T) {
+	ts := getMockTestServer()
+
+	defer logger.setLevel(logger.level())
+
+	code, body, _ := ts.c.Post(nil, "http://test.me/admin/log?level=nope", nil)
+
+	assert.Equal(t, 400, code, "unknown level should be rejected")
+
+	code, body, _ = ts.c.Post(nil, "http://test.me/admin/log?level=debug", nil)
+
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"level":"debug"}`, string(body))
+	assert.Equal(t, levelDebug, logger.level())
+}
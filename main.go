@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mailru/easyjson"
@@ -18,76 +25,283 @@ type Msg struct {
 	Time   int64     `json:"time"`
 	Tag    string    `json:"tag"`
 	Values []float64 `json:"values"`
+	// values of tags with typed schema fields: float64, int64, bool,
+	// string, or nil for nulls, instead of `Values`. see typeValues
+	Typed []interface{} `json:"-"`
 }
 
 func main() {
-	log.Println("> starting on :8080")
+	var err error
 
-	db := getDB("jet")
+	// `poc rebalance|catchup|backfill [apply] [flags]` run maintenance commands, see
+	// `commands`
+	args := os.Args[1:]
+	cmd, apply := "", false
 
-	msgChan := db.startQueueConsumer()
+	if len(args) > 0 && commands[args[0]] != nil {
+		cmd, args = args[0], args[1:]
+		apply = len(args) > 0 && args[0] == "apply"
 
-	defer close(msgChan)
+		if apply {
+			args = args[1:]
+		}
+	}
+
+	if conf, err = loadConfig(args); err != nil {
+		logger.fatal("can't load config", "error", err)
+	}
+
+	level, _ := parseLevel(conf.Log.Level)
+
+	logger.setLevel(level)
+
+	if cmd != "" {
+		if err := commands[cmd](getDB("jet").(KDB), apply); err != nil {
+			logger.fatal(cmd+" failed", "apply", apply, "error", err)
+		}
+
+		return
+	}
+
+	logger.info("starting", "addr", conf.Addr, "config", conf.flat())
+
+	db := withCache(getDB("jet"), conf.API.CacheBytes)
+
+	var keys *keyStore
+
+	if conf.Auth.KeysFile == "" {
+		logger.warn("auth is disabled, set auth.keysFile to require API keys")
+	} else {
+		if keys, err = loadKeys(conf.Auth.KeysFile); err != nil {
+			logger.fatal("can't load API keys", "path", conf.Auth.KeysFile, "error", err)
+		}
+
+		logger.info("API keys loaded", "path", conf.Auth.KeysFile, "keys", len(keys.get().byKey), "certs", len(keys.get().byCert))
+
+		go keys.watch(conf.Auth.ReloadInterval)
+	}
+
+	limits := newRateLimits(conf.RateLimit)
+
+	go limits.sweep(conf.RateLimit.SweepInterval)
+
+	in := newIntake(db.startQueueConsumer())
+
+	ln, err := net.Listen("tcp4", conf.Addr)
+
+	if err != nil {
+		logger.fatal("can't listen", "addr", conf.Addr, "error", err)
+	}
+
+	if conf.TLS.CertFile != "" {
+		certs, err := loadTLS(conf.TLS)
+
+		if err != nil {
+			logger.fatal("can't load TLS certificates", "cert", conf.TLS.CertFile, "key", conf.TLS.KeyFile, "clientCA", conf.TLS.ClientCAFile, "error", err)
+		}
+
+		go certs.watch(conf.TLS.ReloadInterval)
+
+		ln = tls.NewListener(ln, certs.serverConfig())
+
+		logger.info("serving TLS", "minVersion", conf.TLS.MinVersion, "ciphers", conf.TLS.Ciphers, "clientAuth", conf.TLS.ClientAuth)
+	}
+
+	retention = newPruner(db, conf.Retention, conf.Tenants)
+
+	go retention.schedule()
+
+	cl := newCluster(conf.Cluster, conf.TLS.CertFile != "")
+
+	if cl != nil {
+		logger.info("cluster mode", "self", conf.Cluster.Self, "peers", conf.Cluster.Peers)
+
+		go cl.run(conf.Cluster.GossipInterval)
+	}
+
+	s := &fasthttp.Server{
+		Handler: fhMux(db, in, keys, limits, cl, retention),
+	}
+
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			logger.fatal("server failed", "error", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+
+	logger.info("shutting down", "signal", sig, "queued", len(in.msgs), "timeout", conf.ShutdownTimeout)
+
+	ln.Close()
+	in.close()
 
-	fasthttp.ListenAndServe(":8080", fhMux(db, msgChan))
+	if lost := db.stop(conf.ShutdownTimeout); lost > 0 {
+		logger.error("shutdown done, messages were lost", "lost", lost)
+		os.Exit(1)
+	}
+
+	logger.info("shutdown done, all messages were saved")
+}
+
+// maintenance commands print what they would do, and do it with `apply`:
+// - rebalance moves tags stored on shards not owning them, after shards
+// were added, to their owners
+// - catchup copies rows, that a replica or primary missed with
+// `replication.ack` one, from the other one
+// - backfill rebuilds rollups of stored tags from their raw rows
+var commands = map[string]func(db KDB, apply bool) error{
+	"rebalance": func(db KDB, apply bool) error { return db.rebalance(apply, os.Stdout) },
+	"catchup":   func(db KDB, apply bool) error { return db.catchUp(apply, os.Stdout) },
+	"backfill":  func(db KDB, apply bool) error { return db.backfill(apply, os.Stdout) },
 }
 
-func fhMux(db Database, msgChan chan Msg) func(*fasthttp.RequestCtx) {
-	log.Println("> fhMux started")
-	ready := make(chan bool, 1)
-	ready <- true
+// intake guards sends to msgChan, so it can be closed on shutdown while
+// `/save` requests are still in flight
+type intake struct {
+	mu     sync.RWMutex
+	closed bool
+	msgs   chan Msg
+}
+
+func newIntake(msgs chan Msg) *intake {
+	return &intake{msgs: msgs}
+}
+
+// send puts `m` on msgChan, returns false once intake is closed
+func (in *intake) send(m Msg) bool {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+
+	if in.closed {
+		return false
+	}
+
+	in.msgs <- m
+
+	return true
+}
+
+// close waits for running sends, after it returns msgChan can be closed
+func (in *intake) close() {
+	in.mu.Lock()
+	in.closed = true
+	in.mu.Unlock()
+}
+
+// fhMux routes requests to handlers, once they pass API key authorization,
+// tenant resolution and rate limits. `keys` and `limits` can be nil to
+// disable them
+func fhMux(db Database, in *intake, keys *keyStore, limits *rateLimits, cl *cluster, pr *pruner) func(*fasthttp.RequestCtx) {
+	logger.debug("fhMux started")
+
+	tenants := tenantMap(conf.Tenants)
 
 	return func(ctx *fasthttp.RequestCtx) {
-		switch string(ctx.Path()) {
-		case "/health":
-			healthCheck(ctx)
+		path := string(ctx.Path())
+
+		if strings.HasPrefix(path, "/cluster/") {
+			cl.handle(in, ctx, path)
+			return
+		}
+
+		if !keys.authorize(ctx, path) {
+			logger.every("fhMux.auth", time.Second).warn("unauthorized request", "path", path, "ip", ctx.RemoteIP(), "client", clientName(ctx), "status", ctx.Response.StatusCode())
+			return
+		}
+
+		if !resolveTenant(ctx, keys != nil, tenants) {
+			logger.every("fhMux.tenant", time.Second).warn("unknown tenant", "path", path, "ip", ctx.RemoteIP(), "client", clientName(ctx))
+			return
+		}
+
+		if !limits.allow(ctx, path) {
+			logger.every("fhMux.rateLimit", time.Second).warn("rate limited request", "path", path, "ip", ctx.RemoteIP(), "client", clientName(ctx))
+			return
+		}
+
+		switch path {
+		case "/health", "/health/live":
+			liveHandler(ctx)
+		case "/health/ready":
+			readyHandler(db, ctx)
+		case "/metrics":
+			metricsHandler(ctx)
+		case "/admin/log":
+			logLevelHandler(ctx)
+		case "/admin/config":
+			configHandler(ctx)
+		case "/admin/retention":
+			retentionHandler(pr, ctx)
 		case "/save":
-			saveHandler(msgChan, ctx)
+			saveHandler(in, limits, cl, ctx)
 		case "/api":
-			apiHandler(db, ctx, ready)
+			s := time.Now()
+			apiHandler(db, ctx, tenants)
+			apiLatency.with(strconv.Itoa(ctx.Response.StatusCode())).observe(time.Now().Sub(s).Seconds())
+		case "/tags":
+			tagsHandler(db, ctx)
+		case "/export":
+			exportHandler(db, ctx, tenants)
 		default:
 			ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 		}
 	}
 }
 
-func healthCheck(ctx *fasthttp.RequestCtx) {
-	ctx.WriteString("OK")
-}
-
-// func apiHandler(db Database) gin.HandlerFunc {
-func apiHandler(db Database, ctx *fasthttp.RequestCtx, ready chan bool) {
-	// serialize access to client queries, preventing
-	// concurrent reads. current implementation reloads
-	// kdb+ table on each client query, and they don't
-	// seem to play well on concurrent reloads
+// parseRange parses `start` and `end` args, responding with 400 if `start`
+// is more than `lookback` ago
+func parseRange(ctx *fasthttp.RequestCtx, lookback time.Duration) (int64, int64, bool) {
 	args := ctx.QueryArgs()
 
-	<-ready
-
-	defer func() {
-		ready <- true
-	}()
-
-	s := time.Now()
-
 	start, err := strconv.ParseInt(string(args.Peek("start")), 10, 64)
 
 	if err != nil {
-		log.Printf("!> error parsing 'start' from '%s'", args.Peek("start"))
+		logger.warn("can't parse 'start'", "start", string(args.Peek("start")), "error", err)
 	}
 
-	startMin := time.Now().Add(-24 * time.Hour).UnixNano()
+	startMin := time.Now().Add(-lookback).UnixNano()
 
 	if start < startMin {
-		ctx.Error("'start' should be max 24h from now", fasthttp.StatusBadRequest)
-		return
+		ctx.Error(fmt.Sprintf("'start' should be max %v from now", lookback), fasthttp.StatusBadRequest)
+		return 0, 0, false
 	}
 
 	end, err := strconv.ParseInt(string(args.Peek("end")), 10, 64)
 
 	if err != nil {
-		log.Printf("!> error parsing 'end' from '%s'", args.Peek("end"))
+		logger.warn("can't parse 'end'", "end", string(args.Peek("end")), "error", err)
+	}
+
+	return start, end, true
+}
+
+// queryTag is tenant's stored name of `tag` arg, responding with 400 if
+// it's invalid
+func queryTag(ctx *fasthttp.RequestCtx) (string, string, bool) {
+	tag := string(ctx.QueryArgs().Peek("tag"))
+
+	if !validTag(tag) {
+		ctx.Error(fmt.Sprintf("'tag' can't contain %q or NUL", tenantSep), fasthttp.StatusBadRequest)
+		return "", "", false
+	}
+
+	return tag, nsTag(tenantOf(ctx), tag), true
+}
+
+// queries run concurrently: hdb reloads when tp notifies it after a flush,
+// never on a query
+// func apiHandler(db Database) gin.HandlerFunc {
+func apiHandler(db Database, ctx *fasthttp.RequestCtx, tenants map[string]tenantConfig) {
+	s := time.Now()
+
+	start, end, ok := parseRange(ctx, maxLookback(tenants, tenantOf(ctx)))
+
+	if !ok {
+		return
 	}
 
 	/* // disabled for now, interferes with tests, where last written message is
@@ -100,39 +314,228 @@ func apiHandler(db Database, ctx *fasthttp.RequestCtx, ready chan bool) {
 		}
 	*/
 
-	tag := string(args.Peek("tag"))
+	tag, stored, ok := queryTag(ctx)
 
-	res, err := db.getSeries(tag, int64(start), int64(end))
+	if !ok {
+		return
+	}
+
+	proj, ok := parseFields(ctx, stored)
+
+	if !ok {
+		return
+	}
+
+	if !waitVisible(db, ctx, stored) {
+		return
+	}
+
+	res, err := db.getSeries(stored, int64(start), int64(end))
 
 	if err == nil {
-		respJS, _ := json.Marshal(res)
-		ctx.Write(respJS)
+		res.TagName = tag
+		respJS, err := json.Marshal(proj.response(res))
+
+		if err != nil {
+			encodeErrors.inc("/api")
+			logger.error("can't encode getSeries response", "tag", tag, "start", start, "end", end, "error", err)
+			ctx.Error("can't encode response", fasthttp.StatusInternalServerError)
+		} else {
+			ctx.Write(respJS)
+		}
 	} else {
-		fmt.Printf("!> apiHandler db.getSeries failed for ?tag=%v&start=%d&end=%d: %v\n", tag, start, end, err)
+		logger.error("getSeries failed", "tag", tag, "start", start, "end", end, "error", err)
 		ctx.Error("getSeries failed", fasthttp.StatusBadRequest)
 	}
 
 	done := time.Now().Sub(s)
 
-	if done > time.Duration(80*time.Millisecond) {
-		log.Printf("> %v apiHandler getSeries for: %v\n", done, args)
+	if done > conf.API.SlowQuery {
+		logger.warn("slow getSeries", "client", clientName(ctx), "tag", tag, "start", start, "end", end, "duration", done)
 	}
 }
 
+// waitVisible blocks with `waitFor=<int64>` arg, until messages accepted
+// before it are visible, or for `timeout`(default and max `api.maxWait`).
+// after the timeout the query runs anyway, and its `visibleUntil` tells,
+// that the wait failed. responds with 400 on invalid args
+func waitVisible(db Database, ctx *fasthttp.RequestCtx, tag string) bool {
+	args := ctx.QueryArgs()
+
+	if !args.Has("waitFor") {
+		return true
+	}
+
+	waitFor, err := strconv.ParseInt(string(args.Peek("waitFor")), 10, 64)
+
+	if err != nil {
+		ctx.Error("can't parse 'waitFor'", fasthttp.StatusBadRequest)
+		return false
+	}
+
+	timeout := conf.API.MaxWait
+
+	if t := args.Peek("timeout"); len(t) > 0 {
+		d, err := time.ParseDuration(string(t))
+
+		if err != nil || d < 0 {
+			ctx.Error("'timeout' should be a duration, like 2s", fasthttp.StatusBadRequest)
+			return false
+		}
+
+		if d < timeout {
+			timeout = d
+		}
+	}
+
+	db.waitVisible(tag, waitFor, timeout)
+
+	return true
+}
+
 // parse incoming json messages and put them on `msgChan` for further
 // processing to DB specific structures and batching
 // func saveHandler(msgChan chan Msg) gin.HandlerFunc {
-func saveHandler(msgChan chan Msg, ctx *fasthttp.RequestCtx) {
-	// log.Printf("> saveHandler start, req body: %s\n", ctx.Request.Body())
-	var m Msg
+func saveHandler(in *intake, limits *rateLimits, cl *cluster, ctx *fasthttp.RequestCtx) {
+	m, decoded, err := decodeMsg(ctx.Request.Body())
 
-	if err := easyjson.Unmarshal(ctx.Request.Body(), &m); err != nil {
-		log.Printf("!> error decoding json", err)
+	if err != nil {
+		msgRejected.inc("decode")
+		logger.every("saveHandler.decode", time.Second).warn("can't decode message", "client", clientName(ctx), "error", err)
 		ctx.Error("getSeries failed", fasthttp.StatusBadRequest)
 		return
 	}
 
-	msgChan <- m
+	if !tagAllowed(ctx, m.Tag) {
+		authFailures.inc("tag")
+		msgRejected.inc("auth")
+		ctx.Error("API key isn't allowed to write this tag", fasthttp.StatusForbidden)
+		return
+	}
+
+	if !validTag(m.Tag) {
+		msgRejected.inc("tag")
+		ctx.Error(fmt.Sprintf("'tag' can't contain %q or NUL", tenantSep), fasthttp.StatusBadRequest)
+		return
+	}
+
+	m.Tag = nsTag(tenantOf(ctx), m.Tag)
+
+	if reason, err := typeValues(&m, ctx.Request.Body(), decoded); err != nil {
+		msgRejected.inc(reason)
+		ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+
+	if !limits.allowTag(ctx, m.Tag) {
+		msgRejected.inc("rateLimit")
+		return
+	}
+
+	// in cluster mode, the tag's owner batches it. if it can't be reached,
+	// e.g. it died and gossip didn't notice yet, the message is kept here
+	if owner := cl.owner(m.Tag); owner != "" && owner != cl.self {
+		err := cl.forward(owner, m)
+
+		if err == nil {
+			clusterForwards.inc("ok")
+			ctx.WriteString("OK")
+			return
+		}
+
+		clusterForwards.inc("error")
+		logger.every("saveHandler.forward."+owner, time.Second).warn("can't forward message to its owner, keeping it", "owner", owner, "tag", m.Tag, "error", err)
+	}
+
+	if !in.send(m) {
+		msgRejected.inc("shutdown")
+		ctx.Error("shutting down", fasthttp.StatusServiceUnavailable)
+		return
+	}
 
 	ctx.WriteString("OK")
 }
+
+// `GET /tags?prefix=<string>` lists tenant's tags, that the API key can read,
+// as a sorted JSON array
+func tagsHandler(db Database, ctx *fasthttp.RequestCtx) {
+	all, err := db.getTags()
+
+	if err != nil {
+		logger.error("getTags failed", "error", err)
+		ctx.Error("getTags failed", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	tenant, prefix := tenantOf(ctx), string(ctx.QueryArgs().Peek("prefix"))
+
+	tags := []string{}
+
+	for _, stored := range all {
+		t, tag := splitTag(stored)
+
+		if t == tenant && strings.HasPrefix(tag, prefix) && tagAllowed(ctx, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	sort.Strings(tags)
+
+	respJS, _ := json.Marshal(tags)
+
+	ctx.SetContentType("application/json")
+	ctx.Write(respJS)
+}
+
+// `GET /export?tag=<string>&start=<int64>&end=<int64>` returns raw rows of
+// a tag as JSON lines in `/save` message format, so they can be replayed.
+// `fields=<a,b,...>` selects values, like for `/api`
+func exportHandler(db Database, ctx *fasthttp.RequestCtx, tenants map[string]tenantConfig) {
+	start, end, ok := parseRange(ctx, maxLookback(tenants, tenantOf(ctx)))
+
+	if !ok {
+		return
+	}
+
+	tag, stored, ok := queryTag(ctx)
+
+	if !ok {
+		return
+	}
+
+	proj, ok := parseFields(ctx, stored)
+
+	if !ok {
+		return
+	}
+
+	samples, err := db.exportSeries(stored, start, end)
+
+	if err != nil {
+		logger.error("exportSeries failed", "tag", stored, "start", start, "end", end, "error", err)
+		ctx.Error("exportSeries failed", fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetContentType("application/x-ndjson")
+
+	enc := json.NewEncoder(ctx)
+
+	for _, s := range samples {
+		if proj.names != nil {
+			enc.Encode(namedMsg{s.Time, tag, proj.named(s)})
+			continue
+		}
+
+		m := Msg{s.Time, tag, proj.values(s.Values), nil}
+
+		// easyjson writes NaN, that isn't JSON
+		if hasNaN(m.Values) {
+			enc.Encode(jsonMsg(m))
+			continue
+		}
+
+		easyjson.MarshalToWriter(m, ctx)
+		ctx.WriteString("\n")
+	}
+}
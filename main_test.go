@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/httptest"
@@ -25,7 +26,7 @@ type mockDB struct {
 	interval time.Duration
 }
 
-func (mdb mockDB) saveBatch() {
+func (mdb mockDB) saveBatch(int) {
 	return
 }
 
@@ -37,14 +38,48 @@ func (mdb mockDB) getIntervalSample(string, int64, int64) (sample, error) {
 	return sample{}, nil
 }
 
+func (mdb mockDB) getTags() ([]string, error) {
+	return []string{"test_tag", "test_tag2", "other", "acme:test_tag", "acme:sensor.1", "globex:test_tag"}, nil
+}
+
+func (mdb mockDB) exportSeries(tag string, start int64, end int64) (Samples, error) {
+	return Samples{{start + 1, []float64{1}, nil}, {start + 2, []float64{2, 3}, nil}}, nil
+}
+
+func (mdb mockDB) prune(func(string) int64) (int, int, error) {
+	return 0, 0, nil
+}
+
 func (mdb mockDB) query(string) error {
 	return nil
 }
 
+func (mdb mockDB) health() map[string]healthStatus {
+	return map[string]healthStatus{"mock": statusOf(nil)}
+}
+
+func (mdb mockDB) stop(time.Duration) int {
+	return 0
+}
+
+func (mdb mockDB) visibleUntil(string) (int64, error) {
+	return 2000, nil
+}
+
+func (mdb mockDB) waitVisible(string, int64, time.Duration) {}
+
+func (mdb mockDB) tagWrites(string, int64) (tagWrites, error) {
+	return tagWrites{}, nil
+}
+
+func (mdb mockDB) samplePoints(string, *tier, int64, []int64) ([]pointSample, error) {
+	return nil, nil
+}
+
 func (mdb mockDB) getSeries(tag string, start int64, end int64) (APIResponse, error) {
-	mockSample := sample{1000, []float64{1, 2, 3}}
+	mockSample := sample{1000, []float64{1, 2, 3}, nil}
 
-	return APIResponse{tag, start, end, []sample{mockSample}}, nil
+	return APIResponse{tag, start, end, []sample{mockSample}, 2000}, nil
 }
 
 func TestGetSeries(t *testing.T) {
@@ -74,14 +109,39 @@ func TestGetSeries(t *testing.T) {
 		t.Fatal("error decoding API response", e, body)
 	}
 
-	mockSample := sample{1000, []float64{1, 2, 3}}
+	mockSample := sample{1000, []float64{1, 2, 3}, nil}
 
-	expected := APIResponse{"test_tag2", start, end, []sample{mockSample}}
+	expected := APIResponse{"test_tag2", start, end, []sample{mockSample}, 2000}
 
 	assert.Equal(t, expected, data, "resp body should match")
 	assert.Equal(t, 200, statusCode, "should get a 200")
 }
 
+// infDB returns values, that can't be encoded as JSON
+type infDB struct {
+	mockDB
+}
+
+func (db infDB) getSeries(tag string, start int64, end int64) (APIResponse, error) {
+	return APIResponse{tag, start, end, []sample{{1000, []float64{math.Inf(1)}, nil}}, 2000}, nil
+}
+
+func TestGetSeriesEncodeError(t *testing.T) {
+	t.Parallel()
+
+	start := time.Now().Add(-10 * time.Hour).UnixNano()
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(fmt.Sprintf("http://test.me/api?start=%d&end=%d&tag=test_tag", start, start+int64(time.Hour)))
+
+	failed := encodeErrors.get("/api")
+
+	apiHandler(infDB{}, ctx, nil)
+
+	assert.Equal(t, 500, ctx.Response.StatusCode(), "unencodable responses shouldn't be empty 200s")
+	assert.Equal(t, failed+1, encodeErrors.get("/api"))
+}
+
 func TestSave(t *testing.T) {
 	t.Parallel()
 
@@ -95,7 +155,7 @@ func TestSave(t *testing.T) {
 	resp := fasthttp.AcquireResponse()
 	req.SetRequestURI(url)
 
-	testMessage := Msg{1000, "test_tag", []float64{1.1}}
+	testMessage := Msg{1000, "test_tag", []float64{1.1}, nil}
 
 	jsonMsg, _ := json.Marshal(testMessage)
 
@@ -113,6 +173,30 @@ func TestSave(t *testing.T) {
 	assert.Equal(t, testMessage, <-ts.in, "should appear in chan")
 }
 
+func TestSaveAfterShutdown(t *testing.T) {
+	t.Parallel()
+
+	msgs := make(chan Msg, 1)
+	in := newIntake(msgs)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetBodyString(`{"time":1000,"tag":"test_tag","values":[1.1]}`)
+
+	saveHandler(in, nil, nil, ctx)
+
+	assert.Equal(t, 200, ctx.Response.StatusCode(), "should get a 200")
+	assert.Equal(t, 1, len(msgs), "should appear in chan")
+
+	in.close()
+
+	ctx.Response.Reset()
+
+	saveHandler(in, nil, nil, ctx)
+
+	assert.Equal(t, 503, ctx.Response.StatusCode(), "should reject messages once intake is closed")
+	assert.Equal(t, 1, len(msgs), "shouldn't send to msgChan after close")
+}
+
 func TestHealth(t *testing.T) {
 	t.Parallel()
 
@@ -121,6 +205,21 @@ func TestHealth(t *testing.T) {
 	_, body, _ := ts.c.Get(nil, "http://test.me/health")
 
 	assert.Equal(t, "OK", string(body), "should return 'OK'")
+
+	_, body, _ = ts.c.Get(nil, "http://test.me/health/live")
+
+	assert.Equal(t, "OK", string(body), "should return 'OK'")
+}
+
+func TestReady(t *testing.T) {
+	t.Parallel()
+
+	ts := getMockTestServer()
+
+	code, body, _ := ts.c.Get(nil, "http://test.me/health/ready")
+
+	assert.Equal(t, 200, code, "should get a 200")
+	assert.JSONEq(t, `{"status":"ok","components":{"mock":{"status":"ok"}}}`, string(body))
 }
 
 func TestMaxEnd(t *testing.T) {
@@ -174,7 +273,7 @@ func BenchmarkEasyJSON(b *testing.B) {
 		c.String(200, m.Tag)
 	})
 
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 
 	w := httptest.NewRecorder()
 
@@ -199,7 +298,7 @@ func BenchmarkGinJSON(b *testing.B) {
 		c.String(200, m.Tag)
 	})
 
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 	// fmt.Printf("> %+q\n", jsonMsg)
 
 	w := httptest.NewRecorder()
@@ -232,7 +331,7 @@ func BenchmarkGJSON(b *testing.B) {
 		c.String(200, m.Tag)
 	})
 
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 	// fmt.Printf("> %+q\n", jsonMsg)
 
 	w := httptest.NewRecorder()
@@ -245,7 +344,7 @@ func BenchmarkGJSON(b *testing.B) {
 }
 
 func BenchmarkEchoJSON(b *testing.B) {
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 
 	e := echo.New()
 
@@ -270,7 +369,7 @@ func BenchmarkEchoJSON(b *testing.B) {
 
 func BenchmarkJSON(b *testing.B) {
 	var m Msg
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 
 	for i := 0; i < b.N; i++ {
 
@@ -282,7 +381,7 @@ func BenchmarkJSON(b *testing.B) {
 
 func BenchmarkGJSON_(b *testing.B) {
 	var m Msg
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 
 	for i := 0; i < b.N; i++ {
 
@@ -294,7 +393,7 @@ func BenchmarkGJSON_(b *testing.B) {
 
 func BenchmarkEJSON_(b *testing.B) {
 	var m Msg
-	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}})
+	jsonMsg, _ := json.Marshal(Msg{time.Now().UnixNano(), "tag", []float64{1.2, 2.3, 3.4, 4.5, 5.1, 6.89, 7.0, 8.12, 9.99, 10.10}, nil})
 
 	for i := 0; i < b.N; i++ {
 
@@ -307,13 +406,27 @@ func BenchmarkEJSON_(b *testing.B) {
 func getMockTestServer() testData {
 	db := mockDB{}
 
-	in := db.startQueueConsumer()
+	return getServer(db, newIntake(db.startQueueConsumer()), nil, nil, nil, nil)
+}
 
-	s := &fasthttp.Server{
-		Handler: fhMux(db, in),
+// getServer serves fhMux of `db` on an in-memory listener, with a client,
+// that reaches it. nil `keys`, `limits`, `cl` and `pr` are disabled
+func getServer(db Database, in *intake, keys *keyStore, limits *rateLimits, cl *cluster, pr *pruner) testData {
+	ln := fasthttputil.NewInmemoryListener()
+	s := serveMux(ln, db, in, keys, limits, cl, pr)
+
+	c := &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
 	}
 
-	ln := fasthttputil.NewInmemoryListener()
+	return testData{ts: s, ln: ln, c: c, db: db, in: in.msgs}
+}
+
+// serveMux serves fhMux on `ln`, e.g. a TLS listener, see getServer
+func serveMux(ln net.Listener, db Database, in *intake, keys *keyStore, limits *rateLimits, cl *cluster, pr *pruner) *fasthttp.Server {
+	s := &fasthttp.Server{Handler: fhMux(db, in, keys, limits, cl, pr)}
 
 	go func() {
 		if err := s.Serve(ln); err != nil {
@@ -321,11 +434,41 @@ func getMockTestServer() testData {
 		}
 	}()
 
-	c := &fasthttp.Client{
-		Dial: func(addr string) (net.Conn, error) {
-			return ln.Dial()
-		},
+	return s
+}
+
+// request sends `body` with `key` in `X-API-Key`, unless it's empty, and
+// `header` name and value pairs. returns status and body, 0 status if the
+// request failed
+func request(c *fasthttp.Client, method string, url string, key string, body string, header ...string) (int, string) {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(method)
+	req.SetRequestURI(url)
+	req.SetBodyString(body)
+
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
 	}
 
-	return testData{s, ln, c, db, in}
+	if err := c.Do(req, resp); err != nil {
+		return 0, ""
+	}
+
+	return resp.StatusCode(), string(resp.Body())
+}
+
+// doWithKey is the status of `request`
+func doWithKey(c *fasthttp.Client, method string, url string, key string, body string) int {
+	code, _ := request(c, method, url, key, body)
+
+	return code
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// metrics, exposed on `GET /metrics` in Prometheus text format
+var (
+	msgQueueDepth   = newGaugeFunc("poc_msgchan_depth", "Messages in msgChan, waiting to be batched.")
+	batchQueueDepth = newGaugeFunc("poc_batch_queue_depth", "Batches in db.out, waiting to be sent to tp.")
+	msgAccepted     = newCounter("poc_messages_accepted_total", "Messages batched, once they passed /save and the consumer's lateness and quota checks.")
+	msgRejected     = newCounterVec("poc_messages_rejected_total", "Messages rejected by /save or by the consumer, never counted as accepted.", "reason")
+	batchRows       = newHistogram("poc_batch_rows", "Rows per batch sent to tp.", []float64{100, 1000, 10000, 50000, 100000, 200000})
+	batchFlush      = newHistogram("poc_batch_flush_seconds", "Time to send a batch to tp.", latencyBuckets)
+	kdbErrors       = newCounterVec("poc_kdb_errors_total", "Failed kdb+ calls.", "conn")
+	kdbReconnects   = newCounterVec("poc_kdb_reconnects_total", "Broken kdb+ connections, that were redialed.", "conn")
+	tpJournaled     = newCounterVec("poc_tp_journaled_total", "Batches found in tp's journal after their send failed, so not resent.", "conn")
+	seriesQueries   = newCounterVec("poc_series_queries_total", "getSeries queries, by rollup tier or raw.", "tier")
+	cacheHits       = newCounter("poc_series_cache_hits_total", "Series points taken from the cache.")
+	cacheMisses     = newCounter("poc_series_cache_misses_total", "Series points queried, as they weren't cached or were still open.")
+	cacheHitRatio   = newGaugeFunc("poc_series_cache_hit_ratio", "Share of series points taken from the cache, since start.")
+	cacheBytes      = newGaugeFunc("poc_series_cache_bytes", "Approximate memory of cached series points.")
+	encodeErrors    = newCounterVec("poc_encode_errors_total", "Responses, that couldn't be encoded as JSON, by route.", "route")
+	apiLatency      = newHistogramVec("poc_api_request_seconds", "/api request latency.", "status", latencyBuckets)
+	rateLimited     = newCounterVec("poc_rate_limited_total", "Requests rejected by rate limits, by route and key kind.", "limit")
+	rateBuckets     = newGaugeFunc("poc_rate_limit_buckets", "Rate limit buckets, that aren't full, as of the last sweep.")
+	authFailures    = newCounterVec("poc_auth_failures_total", "Requests rejected by API key authorization.", "reason")
+	replicationGaps = newCounterVec("poc_replication_gaps_total", "Batches, that a backend missed with replication.ack one, logged for catchup.", "backend")
+	hdbFailovers    = newCounter("poc_hdb_failovers_total", "hdb queries retried on the replica, after the primary failed.")
+	clusterMembers  = newGaugeFunc("poc_cluster_members", "Alive cluster members, including this one.")
+	clusterForwards = newCounterVec("poc_cluster_forwards_total", "Messages forwarded to their tag's owner, by result.", "result")
+	pruneRuns       = newCounterVec("poc_retention_runs_total", "Retention prune runs, by result.", "result")
+	prunedRows      = newCounter("poc_retention_pruned_rows_total", "Expired rows dropped by retention.")
+	ingestLag       = newHistogram("poc_ingest_lag_seconds", "Age of the oldest message of a batch, when the hdb watermark passed it, so it's visible to queries.", []float64{0.1, 0.25, 0.5, 1, 1.5, 2, 3, 5, 10})
+)
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// metric is anything, that can be written in Prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// all metrics, in order of declaration
+var registry []metric
+
+func metricsHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4")
+
+	for _, m := range registry {
+		m.write(ctx)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func newCounter(name string, help string) *counter {
+	c := &counter{name: name, help: help}
+
+	registry = append(registry, c)
+
+	return c
+}
+
+func (c *counter) inc() uint64 {
+	return c.add(1)
+}
+
+func (c *counter) add(n uint64) uint64 {
+	return atomic.AddUint64(&c.value, n)
+}
+
+func (c *counter) get() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *counter) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.get())
+}
+
+// counterVec is a counter partitioned by values of a single label
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.RWMutex
+	values map[string]*uint64
+}
+
+func newCounterVec(name string, help string, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, values: make(map[string]*uint64)}
+
+	registry = append(registry, c)
+
+	return c
+}
+
+func (c *counterVec) inc(value string) uint64 {
+	c.mu.RLock()
+	v, ok := c.values[value]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+
+		if v, ok = c.values[value]; !ok {
+			v = new(uint64)
+			c.values[value] = v
+		}
+
+		c.mu.Unlock()
+	}
+
+	return atomic.AddUint64(v, 1)
+}
+
+func (c *counterVec) get(value string) uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if v, ok := c.values[value]; ok {
+		return atomic.LoadUint64(v)
+	}
+
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, atomic.LoadUint64(c.values[k]))
+	}
+}
+
+// gaugeFunc is a gauge, that's evaluated on each scrape
+type gaugeFunc struct {
+	name string
+	help string
+	mu   sync.Mutex
+	fn   func() float64
+}
+
+func newGaugeFunc(name string, help string) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help}
+
+	registry = append(registry, g)
+
+	return g
+}
+
+func (g *gaugeFunc) set(fn func() float64) {
+	g.mu.Lock()
+	g.fn = fn
+	g.mu.Unlock()
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.mu.Lock()
+	fn := g.fn
+	g.mu.Unlock()
+
+	if fn == nil {
+		return
+	}
+
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(fn()))
+}
+
+// histogram counts observations in `buckets` upper bounds, non cumulative
+// counts are kept per bucket and summed up on write
+type histogram struct {
+	name    string
+	help    string
+	labels  string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     uint64
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	h := makeHistogram(name, help, "", buckets)
+
+	registry = append(registry, h)
+
+	return h
+}
+
+func makeHistogram(name string, help string, labels string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.writeSeries(w)
+}
+
+func (h *histogram) writeSeries(w io.Writer) {
+	var cumulative uint64
+
+	for i := range h.counts {
+		le := math.Inf(1)
+
+		if i < len(h.buckets) {
+			le = h.buckets[i]
+		}
+
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, h.labels, formatFloat(le), cumulative)
+	}
+
+	labels := h.labels
+
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+
+	fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))))
+	fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, atomic.LoadUint64(&h.count))
+}
+
+// histogramVec is a histogram partitioned by values of a single label
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mu      sync.RWMutex
+	values  map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, label string, buckets []float64) *histogramVec {
+	h := &histogramVec{name: name, help: help, label: label, buckets: buckets, values: make(map[string]*histogram)}
+
+	registry = append(registry, h)
+
+	return h
+}
+
+func (h *histogramVec) with(value string) *histogram {
+	h.mu.RLock()
+	hist, ok := h.values[value]
+	h.mu.RUnlock()
+
+	if ok {
+		return hist
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hist, ok = h.values[value]; !ok {
+		hist = makeHistogram(h.name, h.help, fmt.Sprintf("%s=%q,", h.label, value), h.buckets)
+		h.values[value] = hist
+	}
+
+	return hist
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, k := range sortedKeys(h.values) {
+		h.values[k].writeSeries(w)
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+
+	switch m := m.(type) {
+	case map[string]*uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramExposition(t *testing.T) {
+	h := makeHistogram("test_seconds", "test", "", []float64{0.1, 1})
+
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(5)
+
+	var buf bytes.Buffer
+
+	h.write(&buf)
+
+	expected := strings.Join([]string{
+		"# HELP test_seconds test",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="0.1"} 1`,
+		`test_seconds_bucket{le="1"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 5.55",
+		"test_seconds_count 3",
+		"",
+	}, "\n")
+
+	assert.Equal(t, expected, buf.String(), "should be cumulative buckets with sum and count")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	t.Parallel()
+
+	ts := getMockTestServer()
+
+	apiLatency.with("200").observe(0.01)
+	msgRejected.inc("decode")
+
+	code, body, _ := ts.c.Get(nil, "http://test.me/metrics")
+
+	assert.Equal(t, 200, code, "should get a 200")
+	assert.Contains(t, string(body), "# TYPE poc_messages_accepted_total counter\n", "should expose accepted messages")
+	assert.Contains(t, string(body), `poc_api_request_seconds_bucket{status="200",le="0.01"}`, "should label /api latency by status")
+	assert.Contains(t, string(body), `poc_messages_rejected_total{reason="decode"}`, "should label rejected messages by reason")
+}
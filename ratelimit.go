@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// limiter is a set of token buckets, one per key, with the same rate and
+// burst. each bucket is a single int64, the time it's full again(GCRA), so
+// `allow` takes no locks: a map load and a CAS loop
+type limiter struct {
+	name     string
+	interval int64 // ns per token
+	burst    int64 // ns worth of tokens a bucket holds
+	buckets  sync.Map
+}
+
+// newLimiter returns nil, allowing everything, when `l.Rate` is 0
+func newLimiter(name string, l rateLimit) *limiter {
+	if l.Rate <= 0 {
+		return nil
+	}
+
+	interval := int64(float64(time.Second) / l.Rate)
+
+	burst := l.Burst
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &limiter{name: name, interval: interval, burst: int64(burst) * interval}
+}
+
+// allow takes a token from `key` bucket. if it's empty, returns false and
+// time until the next token
+func (l *limiter) allow(key string, now int64) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	v, ok := l.buckets.Load(key)
+
+	if !ok {
+		v, _ = l.buckets.LoadOrStore(key, new(int64))
+	}
+
+	full := v.(*int64)
+
+	for {
+		old := atomic.LoadInt64(full)
+
+		t := old
+
+		if t < now {
+			t = now
+		}
+
+		t += l.interval
+
+		if t-now > l.burst {
+			return false, time.Duration(t - now - l.burst)
+		}
+
+		if atomic.CompareAndSwapInt64(full, old, t) {
+			return true, 0
+		}
+	}
+}
+
+// sweep drops full buckets, so keys seen once don't stay forever. a request
+// racing with it can get a fresh bucket, which only lets a burst through
+func (l *limiter) sweep(now int64) int {
+	if l == nil {
+		return 0
+	}
+
+	kept := 0
+
+	l.buckets.Range(func(k, v interface{}) bool {
+		if atomic.LoadInt64(v.(*int64)) <= now {
+			l.buckets.Delete(k)
+		} else {
+			kept++
+		}
+
+		return true
+	})
+
+	return kept
+}
+
+// limiters of a route, by API key, client IP and tag
+type routeLimiter struct {
+	key *limiter
+	ip  *limiter
+	tag *limiter
+}
+
+func newRouteLimiter(route string, c routeLimits) routeLimiter {
+	return routeLimiter{
+		key: newLimiter(route+".key", c.Key),
+		ip:  newLimiter(route+".ip", c.IP),
+		tag: newLimiter(route+".tag", c.Tag),
+	}
+}
+
+// rateLimits of `/save` and `/api`
+type rateLimits struct {
+	save    routeLimiter
+	api     routeLimiter
+	buckets int64
+}
+
+func newRateLimits(c rateLimitConfig) *rateLimits {
+	r := &rateLimits{save: newRouteLimiter("save", c.Save), api: newRouteLimiter("api", c.API)}
+
+	rateBuckets.set(func() float64 { return float64(atomic.LoadInt64(&r.buckets)) })
+
+	return r
+}
+
+func (r *rateLimits) route(path string) *routeLimiter {
+	switch path {
+	case "/save":
+		return &r.save
+	case "/api":
+		return &r.api
+	}
+
+	return nil
+}
+
+// allow checks API key and client IP limits of `path`, and `/api` tag,
+// responding with 429 if any of them is exceeded. `/save` checks message
+// tag with `allowTag` after decoding. all requests are allowed, when `r`
+// is nil
+func (r *rateLimits) allow(ctx *fasthttp.RequestCtx, path string) bool {
+	if r == nil {
+		return true
+	}
+
+	rl := r.route(path)
+
+	if rl == nil {
+		return true
+	}
+
+	now := time.Now().UnixNano()
+
+	if name := clientName(ctx); name != "" && !take(ctx, rl.key, name, now) {
+		return false
+	}
+
+	if !take(ctx, rl.ip, ctx.RemoteIP().String(), now) {
+		return false
+	}
+
+	if path == "/api" {
+		return take(ctx, rl.tag, nsTag(tenantOf(ctx), string(ctx.QueryArgs().Peek("tag"))), now)
+	}
+
+	return true
+}
+
+// allowTag checks `/save` limit of stored `tag`, responding with 429 if it's exceeded
+func (r *rateLimits) allowTag(ctx *fasthttp.RequestCtx, tag string) bool {
+	if r == nil {
+		return true
+	}
+
+	return take(ctx, r.save.tag, tag, time.Now().UnixNano())
+}
+
+// take takes a token of `key` from `l`, responding with 429 and `Retry-After`
+// if there are none. returns true if the request is allowed
+func take(ctx *fasthttp.RequestCtx, l *limiter, key string, now int64) bool {
+	ok, wait := l.allow(key, now)
+
+	if ok {
+		return true
+	}
+
+	rateLimited.inc(l.name)
+
+	// Error resets headers, Retry-After is set after it, in whole seconds
+	// rounded up
+	ctx.Error("rate limit exceeded: "+l.name, fasthttp.StatusTooManyRequests)
+	ctx.Response.Header.Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+
+	return false
+}
+
+// sweep drops full buckets each `interval`. runs forever, meant to be
+// started in a goroutine
+func (r *rateLimits) sweep(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		n := 0
+
+		for _, l := range []*limiter{r.save.key, r.save.ip, r.save.tag, r.api.key, r.api.ip, r.api.tag} {
+			n += l.sweep(now.UnixNano())
+		}
+
+		atomic.StoreInt64(&r.buckets, int64(n))
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestLimiterBurstAndRefill(t *testing.T) {
+	l := newLimiter("test", rateLimit{Rate: 10, Burst: 3})
+
+	now := time.Now().UnixNano()
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a", now)
+		assert.True(t, ok, "burst should be allowed")
+	}
+
+	ok, wait := l.allow("a", now)
+
+	assert.False(t, ok, "should be limited after burst")
+	assert.Equal(t, 100*time.Millisecond, wait, "next token in 1/rate")
+
+	ok, _ = l.allow("b", now)
+	assert.True(t, ok, "keys should have their own buckets")
+
+	ok, _ = l.allow("a", now+int64(100*time.Millisecond))
+	assert.True(t, ok, "should refill at rate")
+
+	assert.Nil(t, newLimiter("off", rateLimit{}), "0 rate is unlimited")
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	l := newLimiter("test", rateLimit{Rate: 1, Burst: 100})
+
+	now := time.Now().UnixNano()
+
+	var allowed int64
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if ok, _ := l.allow("a", now); ok {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, int64(100), allowed, "shouldn't allow more than burst")
+}
+
+func TestLimiterSweep(t *testing.T) {
+	l := newLimiter("test", rateLimit{Rate: 1, Burst: 10})
+
+	now := time.Now().UnixNano()
+
+	l.allow("a", now)
+	l.allow("b", now)
+
+	assert.Equal(t, 2, l.sweep(now), "buckets, that aren't full, should be kept")
+	assert.Equal(t, 0, l.sweep(now+int64(time.Second)), "full buckets should be dropped")
+}
+
+func TestRateLimitResponses(t *testing.T) {
+	c := defaultConfig().RateLimit
+	c.API.Tag = rateLimit{Rate: 0.1, Burst: 1}
+	c.Save.Tag = rateLimit{Rate: 0.5, Burst: 2}
+
+	in := make(chan Msg, 10)
+	client := getServer(mockDB{}, newIntake(in), nil, newRateLimits(c), nil, nil).c
+
+	api := "http://test.me/api?start=" + formatNow(-time.Hour) + "&end=" + formatNow(0) + "&tag="
+
+	code, _, _ := client.Get(nil, api+"tag1")
+	assert.Equal(t, 200, code)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI(api + "tag1")
+
+	client.Do(req, resp)
+
+	assert.Equal(t, 429, resp.StatusCode(), "tag should be limited")
+	assert.Equal(t, "10", string(resp.Header.Peek("Retry-After")), "should retry in 1/rate seconds")
+
+	code, _, _ = client.Get(nil, api+"tag2")
+	assert.Equal(t, 200, code, "other tags shouldn't be limited")
+
+	before := rateLimited.get("save.tag")
+
+	for i, expected := range []int{200, 200, 429} {
+		status := doWithKey(client, "POST", "http://test.me/save", "", `{"time":`+strconv.Itoa(i)+`,"tag":"tag1","values":[1]}`)
+		assert.Equal(t, expected, status)
+	}
+
+	assert.Equal(t, 2, len(in), "limited messages shouldn't reach msgChan")
+	assert.Equal(t, before+1, rateLimited.get("save.tag"))
+}
+
+func BenchmarkLimiter(b *testing.B) {
+	l := newLimiter("bench", rateLimit{Rate: 1e9, Burst: 1e6})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.allow("127.0.0.1", time.Now().UnixNano())
+		}
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// move of a tag from the shard, that stores it, to the one owning it
+type move struct {
+	tag  string
+	from int
+	to   int
+}
+
+// rebalancePlan lists tags in `stored`, by shard, that are on shards not
+// owning them on `r`, e.g. after a shard was added
+func rebalancePlan(r *ring, stored [][]string) []move {
+	var moves []move
+
+	for from, tags := range stored {
+		for _, tag := range tags {
+			if to := r.shard(tag); to != from {
+				moves = append(moves, move{tag, from, to})
+			}
+		}
+	}
+
+	sort.Slice(moves, func(i, j int) bool { return moves[i].tag < moves[j].tag })
+
+	return moves
+}
+
+// rebalance prints misplaced tags to `w`, and with `apply`, moves each of
+// them: rows are copied to the owner's `tp` and persisted, checked on the
+// owner's `hdb`, and then the tag is dropped on the old shard
+func (db KDB) rebalance(apply bool, w io.Writer) error {
+	stored := make([][]string, len(db.hdb))
+
+	for shard := range db.hdb {
+		tags, err := db.shardTags(shard)
+
+		if err != nil {
+			return fmt.Errorf("can't list tags of %s: %v", db.hdb[shard].name, err)
+		}
+
+		stored[shard] = tags
+	}
+
+	moves := rebalancePlan(db.ring, stored)
+
+	for _, m := range moves {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", m.tag, db.shardName(m.from), db.shardName(m.to))
+
+		if !apply {
+			continue
+		}
+
+		if err := db.moveTag(m); err != nil {
+			return fmt.Errorf("can't move %s: %v", m.tag, err)
+		}
+	}
+
+	fmt.Fprintf(w, "%d tags to move\n", len(moves))
+
+	return nil
+}
+
+func (db KDB) shardName(shard int) string {
+	return db.ring.names[shard]
+}
+
+// moveTag copies the tag to the owner's `tp` and its replica, and drops it
+// on the old shard's ones, once all of the owner's hdbs have every row.
+// rows, that the owner already has, e.g. copied by a move, that failed
+// before the drop, aren't copied again
+func (db KDB) moveTag(m move) error {
+	samples, err := db.exportShard(m.from, m.tag, math.MinInt64+1, math.MaxInt64)
+
+	if err != nil {
+		return err
+	}
+
+	hdbs := []*kdbConn{db.hdb[m.to], db.replicaHDB[m.to]}
+
+	var flushed []int64
+
+	for i, tp := range db.writers(m.to * conf.Batch.Workers) {
+		copied, err := flushedRows(tp, hdbs[i], m.tag)
+
+		if err != nil {
+			return err
+		}
+
+		var wm int64
+
+		if missing := missingSamples(samples, copied); len(missing) > 0 {
+			if wm, err = upsert(tp, m.tag, sampleRows(m.tag, missing)); err != nil {
+				return err
+			}
+		}
+
+		flushed = append(flushed, wm)
+	}
+
+	for i, hdb := range hdbs {
+		if hdb == nil {
+			continue
+		}
+
+		if err := waitRefresh(hdb, flushed[i]); err != nil {
+			return err
+		}
+
+		res, err := hdb.call(".P.export_tag", exportArgs(m.tag, math.MinInt64+1, math.MaxInt64)...)
+
+		if err != nil {
+			return err
+		}
+
+		if missing := missingSamples(samples, exportRows(res)); len(missing) > 0 {
+			return fmt.Errorf("%d rows of %d aren't copied to %s, not dropping it on %s", len(missing), len(samples), hdb.name, db.shardName(m.from))
+		}
+	}
+
+	for _, tp := range db.writers(m.from * conf.Batch.Workers) {
+		if _, err := tp.call(".P.drop_tag", kdb.Symbol(m.tag)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushedRows are the tag's rows on `hdb`, once it loaded all of `tp`'s
+// rows, that are persisted by a flush first
+func flushedRows(tp *kdbConn, hdb *kdbConn, tag string) (Samples, error) {
+	wm, err := flush(tp)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := waitRefresh(hdb, wm); err != nil {
+		return nil, err
+	}
+
+	res, err := hdb.call(".P.export_tag", exportArgs(tag, math.MinInt64+1, math.MaxInt64)...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return exportRows(res), nil
+}
+
+// missingSamples are `samples`, that aren't in `have`, by time and values
+func missingSamples(samples Samples, have Samples) Samples {
+	seen := make(map[string]int, len(have))
+
+	for _, s := range have {
+		seen[fmt.Sprint(s.Time, s.Values, s.Typed)]++
+	}
+
+	var missing Samples
+
+	for _, s := range samples {
+		k := fmt.Sprint(s.Time, s.Values, s.Typed)
+
+		if seen[k] > 0 {
+			seen[k]--
+			continue
+		}
+
+		missing = append(missing, s)
+	}
+
+	return missing
+}
+
+// tp rows of the tag's samples
+func sampleRows(tag string, samples Samples) []*kdb.K {
+	rows := make([]*kdb.K, len(samples))
+
+	for i, s := range samples {
+		rows[i] = kdb.NewList(kdb.Symbol(tag), kdb.Long(s.Time), valuesK(s.Values, s.Typed))
+	}
+
+	return rows
+}
+
+// upsert sends rows of a tag to `tp`, persists them right away and rebuilds
+// the tag's rollups. returns the flush's watermark
+func upsert(tp *kdbConn, tag string, rows []*kdb.K) (int64, error) {
+	if _, err := tp.call(".P.tp_add", kdb.NewList(rows...)); err != nil {
+		return 0, err
+	}
+
+	wm, err := flush(tp)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tp.call(".P.backfill_tag", kdb.Symbol(tag))
+
+	return wm, err
+}
+
+// flush persists rows, that `tp` holds, returns the flush's watermark
+func flush(tp *kdbConn) (int64, error) {
+	res, err := tp.call(".P.tp_upsert[]")
+
+	if err != nil {
+		return 0, err
+	}
+
+	wm, ok := res.Data.(int64)
+
+	if !ok {
+		return 0, fmt.Errorf("unexpected .P.tp_upsert result %v", res)
+	}
+
+	return wm, nil
+}
+
+// waitRefresh waits for up to `api.maxWait`, until `hdb` loaded a flush
+// with watermark `wm`, as tp tells it asynchronously
+func waitRefresh(hdb *kdbConn, wm int64) error {
+	deadline := time.Now().Add(conf.API.MaxWait)
+
+	for {
+		res, err := hdb.call(".P.visible_until[]")
+
+		if err != nil {
+			return err
+		}
+
+		if v, ok := res.Data.(int64); ok && v >= wm {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't load the flush in %s", hdb.name, conf.API.MaxWait)
+		}
+
+		time.Sleep(visiblePoll)
+	}
+}
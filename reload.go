@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// newest modification time of `paths`
+func modTime(paths ...string) (time.Time, error) {
+	var newest time.Time
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+
+		if err != nil {
+			return newest, err
+		}
+
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	return newest, nil
+}
+
+// watchFiles calls `reload` once any of `paths` changes, checking them each
+// `interval`. the first check always reloads, so changes made before the
+// watch started aren't missed. failed reloads are logged and retried on the
+// next change. runs forever, meant to be started in a goroutine
+func watchFiles(name string, interval time.Duration, reload func() error, paths ...string) {
+	var last time.Time
+
+	for range time.Tick(interval) {
+		mtime, err := modTime(paths...)
+
+		if err != nil {
+			logger.every(name+".stat", time.Minute).error("can't stat files", "name", name, "paths", paths, "error", err)
+			continue
+		}
+
+		if mtime.Equal(last) {
+			continue
+		}
+
+		last = mtime
+
+		if err := reload(); err != nil {
+			logger.error("can't reload, keeping the old ones", "name", name, "paths", paths, "error", err)
+			continue
+		}
+
+		logger.info("reloaded", "name", name, "paths", paths)
+	}
+}
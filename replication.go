@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// backends of a shard: primary tp/hdb, and replica ones, if configured
+const (
+	backendPrimary = "primary"
+	backendReplica = "replica"
+)
+
+var backendNames = []string{backendPrimary, backendReplica}
+
+// writers of `worker`: its primary tp connection, and replica one
+func (db KDB) writers(worker int) []*kdbConn {
+	if db.replicaTP[worker] == nil {
+		return db.tp[worker : worker+1]
+	}
+
+	return []*kdbConn{db.tp[worker], db.replicaTP[worker]}
+}
+
+// send sends batch `b` and its rollups to worker's tp and its replica, if
+// there's one. with
+// `replication.ack` "both", each of them is retried until it accepts the
+// batch. with "one", the batch is done once either of them accepts it: the
+// other call finishes in the background, and if it fails, or the backend is
+// still busy with an earlier batch, its rows are logged to
+// `replication.gapLog`, for `poc catchup`. a call taking longer than
+// `replication.timeout` fails. batches are numbered per worker, and tp
+// journals them before acknowledging: after a failed send, a batch is only
+// resent, if tp's journal doesn't have it, e.g. when tp crashed before
+// writing it. returns tp's time of the acknowledgement, the primary's,
+// unless only the replica acknowledged, to compare with hdb watermarks
+func (db KDB) send(worker int, b batch) int64 {
+	conns := db.writers(worker)
+	rows, rollups := kdb.NewList(b.rows...), rollupTiers(b.rows)
+	one := conf.Replication.Ack == "one"
+	acked := make([]bool, len(conns))
+	at := int64(0)
+
+	db.state.seqs[worker]++
+
+	src, seq := db.source(worker), db.state.seqs[worker]
+
+	for {
+		res := make(chan saveResult, len(conns))
+		missed := make([]bool, len(conns))
+		pending := 0
+
+		for i, c := range conns {
+			if acked[i] {
+				continue
+			}
+
+			busy := &db.state.sending[worker][i]
+
+			// a backend gets batches in order: with ack one, it misses the
+			// ones sent while it's still saving an earlier one
+			if one && !busy.TryLock() {
+				missed[i] = true
+				continue
+			} else if !one {
+				busy.Lock()
+			}
+
+			pending++
+
+			go func(i int, c *kdbConn) {
+				defer busy.Unlock()
+				at, err := save(c, src, seq, rows, rollups)
+				res <- saveResult{i, at, err}
+			}(i, c)
+		}
+
+		if pending == 0 {
+			// every backend is busy, wait for the primary
+			db.state.sending[worker][0].Lock()
+			db.state.sending[worker][0].Unlock()
+			continue
+		}
+
+		for ; pending > 0; pending-- {
+			r := <-res
+
+			if r.err != nil {
+				logger.every("saveBatch.error."+conns[r.i].name, time.Second).error("can't send batch to tp, retrying", "conn", conns[r.i].name, "batch", len(b.rows), "error", r.err)
+				missed[r.i] = true
+
+				continue
+			}
+
+			acked[r.i] = true
+
+			if r.i == 0 || at == 0 {
+				at = r.at
+			}
+
+			if one {
+				db.missed(worker, b, missed, res, pending-1)
+				return at
+			}
+		}
+
+		if !one {
+			done := true
+
+			for _, ok := range acked {
+				done = done && ok
+			}
+
+			if done {
+				return at
+			}
+		}
+
+		time.Sleep(retryInterval)
+	}
+}
+
+// saveResult of sending a batch to backend `i` of a shard, acknowledged at
+// tp's time `at`
+type saveResult struct {
+	i   int
+	at  int64
+	err error
+}
+
+// save is `.P.tp_save` of batch `seq`, that is also done if `tp` journaled
+// it, but the call failed. returns tp's time, once it has the batch
+func save(tp *kdbConn, src *kdb.K, seq int64, rows *kdb.K, rollups *kdb.K) (int64, error) {
+	res, err := tp.callTimeout(conf.Replication.Timeout, ".P.tp_save", src, kdb.Long(seq), rows, rollups)
+
+	if err != nil {
+		if at, ok := journaled(tp, src, seq); ok {
+			tpJournaled.inc(tp.name)
+			return at, nil
+		}
+
+		return 0, err
+	}
+
+	if r, ok := res.Data.([]int64); ok && len(r) == 2 {
+		return r[1], nil
+	}
+
+	return 0, fmt.Errorf("unexpected .P.tp_save result %v", res)
+}
+
+// missed logs gaps of `b` for backends, that missed it, and in the
+// background, for the `pending` ones, that fail to save it
+func (db KDB) missed(worker int, b batch, missed []bool, res chan saveResult, pending int) {
+	shard := db.shardName(worker / conf.Batch.Workers)
+
+	for i, ok := range missed {
+		if ok {
+			db.state.gaps.add(shard, backendNames[i], b)
+		}
+	}
+
+	if pending == 0 {
+		return
+	}
+
+	db.state.saved.Add(1)
+
+	go func() {
+		defer db.state.saved.Done()
+
+		for ; pending > 0; pending-- {
+			if r := <-res; r.err != nil {
+				logger.every("saveBatch.error."+db.writers(worker)[r.i].name, time.Second).error("can't send batch to tp", "conn", db.writers(worker)[r.i].name, "batch", len(b.rows), "error", r.err)
+				db.state.gaps.add(shard, backendNames[r.i], b)
+			}
+		}
+	}()
+}
+
+// journaled is true, if `tp` has batch `seq` of `src` in its journal, e.g.
+// if the connection broke after tp wrote it, or tp replayed it on restart,
+// with tp's time
+func journaled(tp *kdbConn, src *kdb.K, seq int64) (int64, bool) {
+	res, err := tp.callTimeout(conf.Replication.Timeout, ".P.seq_at", src)
+
+	if err != nil {
+		return 0, false
+	}
+
+	r, ok := res.Data.([]int64)
+
+	if !ok || len(r) != 2 {
+		return 0, false
+	}
+
+	return r[1], r[0] >= seq
+}
+
+// instanceName identifies this app instance among ones sharing tp:
+// `cluster.self`, that stays the same across restarts, or host and pid
+// without it
+func instanceName() string {
+	if conf.Cluster.Self != "" {
+		return conf.Cluster.Self
+	}
+
+	host, _ := os.Hostname()
+
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// source of worker's batches in tp's journal, that numbers them: the
+// instance and worker's tp connection, so instances sharing tp don't skip
+// each other's batches
+func (db KDB) source(worker int) *kdb.K {
+	return kdb.Symbol(db.state.instance + "/" + db.tp[worker].name)
+}
+
+// lastSeq is the last batch of `worker` journaled by its tp or replica
+func (db KDB) lastSeq(worker int) (int64, error) {
+	var seq int64
+
+	for _, tp := range db.writers(worker) {
+		res, err := tp.call(".P.last_seq", db.source(worker))
+
+		if err != nil {
+			return 0, err
+		}
+
+		if last, ok := res.Data.(int64); ok && last > seq {
+			seq = last
+		}
+	}
+
+	return seq, nil
+}
+
+// hdbCall calls `fn` on shard's primary hdb, and on its replica, if the
+// primary fails
+func (db KDB) hdbCall(shard int, fn string, args ...*kdb.K) (*kdb.K, error) {
+	res, err := db.hdb[shard].call(fn, args...)
+
+	if err == nil || db.replicaHDB[shard] == nil {
+		return res, err
+	}
+
+	hdbFailovers.inc()
+	logger.every("hdb.failover."+db.hdb[shard].name, time.Second).warn("hdb query failed, reading from replica", "conn", db.hdb[shard].name, "error", err)
+
+	return db.replicaHDB[shard].call(fn, args...)
+}
+
+// gap is a tag's range of rows, that a backend missed. `poc catchup`
+// copies them from the other backend of the shard
+type gap struct {
+	Shard   string `json:"shard"`
+	Backend string `json:"backend"`
+	Tag     string `json:"tag"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Rows    int    `json:"rows"`
+}
+
+// gapLog appends gaps to a JSON lines file. the file is opened for each
+// batch, so `poc catchup` can move it away while the app is running
+type gapLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// add logs a gap for each tag of `b`
+func (g *gapLog) add(shard string, backend string, b batch) {
+	gaps := make(map[string]*gap)
+
+	var tags []string
+
+	for _, row := range b.rows {
+		tag, ts := row.Data.([]*kdb.K)[0].Data.(string), rowTs(row)
+
+		r, ok := gaps[tag]
+
+		if !ok {
+			r = &gap{shard, backend, tag, ts, ts, 0}
+			gaps[tag] = r
+			tags = append(tags, tag)
+		}
+
+		if ts < r.Start {
+			r.Start = ts
+		}
+
+		if ts > r.End {
+			r.End = ts
+		}
+
+		r.Rows++
+	}
+
+	replicationGaps.inc(backend)
+
+	var list []gap
+
+	for _, tag := range tags {
+		list = append(list, *gaps[tag])
+	}
+
+	if err := g.append(list); err != nil {
+		logger.error("can't log replication gap, run `poc catchup` for the whole shard", "shard", shard, "backend", backend, "path", g.path, "error", err)
+	}
+}
+
+func (g *gapLog) append(gaps []gap) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	f, err := os.OpenFile(g.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	for _, r := range gaps {
+		enc.Encode(r)
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// take moves the log away and returns its gaps
+func (g *gapLog) take() ([]gap, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	taken := fmt.Sprintf("%s.%d", g.path, time.Now().UnixNano())
+
+	if err := os.Rename(g.path, taken); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	f, err := os.Open(taken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var gaps []gap
+
+	dec := json.NewDecoder(f)
+
+	for {
+		var r gap
+
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			return gaps, fmt.Errorf("%s: %v", taken, err)
+		}
+
+		gaps = append(gaps, r)
+	}
+
+	return gaps, os.Remove(taken)
+}
+
+// catchUp prints gaps from `replication.gapLog` to `w`, and with `apply`,
+// copies rows of each gap from the other backend of its shard, skipping
+// timestamps the lagging backend already has. gaps, that can't be copied,
+// are logged again
+func (db KDB) catchUp(apply bool, w io.Writer) error {
+	if !apply {
+		gaps, err := readGaps(db.state.gaps.path)
+
+		for _, g := range gaps {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", g.Shard, g.Backend, g.Tag, g.Start, g.End, g.Rows)
+		}
+
+		fmt.Fprintf(w, "%d gaps\n", len(gaps))
+
+		return err
+	}
+
+	gaps, err := db.state.gaps.take()
+
+	if err != nil {
+		return err
+	}
+
+	var failed []gap
+
+	copied := 0
+
+	for _, g := range gaps {
+		n, err := db.fillGap(g)
+
+		if err != nil {
+			logger.error("can't fill gap, keeping it", "shard", g.Shard, "backend", g.Backend, "tag", g.Tag, "error", err)
+			failed = append(failed, g)
+			continue
+		}
+
+		copied += n
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d rows copied\n", g.Shard, g.Backend, g.Tag, n)
+	}
+
+	fmt.Fprintf(w, "%d gaps filled, %d rows copied, %d gaps left\n", len(gaps)-len(failed), copied, len(failed))
+
+	if len(failed) > 0 {
+		if err := db.state.gaps.append(failed); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("%d gaps left", len(failed))
+	}
+
+	return nil
+}
+
+func readGaps(path string) ([]gap, error) {
+	f, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var gaps []gap
+
+	dec := json.NewDecoder(f)
+
+	for {
+		var g gap
+
+		if err := dec.Decode(&g); err == io.EOF {
+			return gaps, nil
+		} else if err != nil {
+			return gaps, err
+		}
+
+		gaps = append(gaps, g)
+	}
+}
+
+// fillGap copies rows of `g` missing on its backend, returns how many
+func (db KDB) fillGap(g gap) (int, error) {
+	shard := -1
+
+	for i, name := range db.ring.names {
+		if name == g.Shard {
+			shard = i
+		}
+	}
+
+	if shard < 0 || db.replicaHDB[shard] == nil {
+		return 0, fmt.Errorf("shard %q has no replica", g.Shard)
+	}
+
+	worker := shard * conf.Batch.Workers
+
+	from, to, tp := db.replicaHDB[shard], db.hdb[shard], db.tp[worker]
+
+	if g.Backend == backendReplica {
+		from, to, tp = db.hdb[shard], db.replicaHDB[shard], db.replicaTP[worker]
+	}
+
+	// export is (start; end], gap is [start; end]
+	res, err := from.call(".P.export_tag", exportArgs(g.Tag, g.Start-1, g.End)...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	source := exportRows(res)
+
+	res, err = to.call(".P.export_tag", exportArgs(g.Tag, g.Start-1, g.End)...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	have := make(map[int64]bool)
+
+	for _, s := range exportRows(res) {
+		have[s.Time] = true
+	}
+
+	var missing Samples
+
+	for _, s := range source {
+		if !have[s.Time] {
+			missing = append(missing, s)
+		}
+	}
+
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	_, err = upsert(tp, g.Tag, sampleRows(g.Tag, missing))
+
+	return len(missing), err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+func TestGapLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "poc-gaps")
+	defer os.RemoveAll(dir)
+
+	g := &gapLog{path: filepath.Join(dir, "gaps.jsonl")}
+
+	var b batch
+
+	for _, m := range []Msg{{300, "a", []float64{1}, nil}, {100, "b", []float64{2}, nil}, {200, "a", []float64{3}, nil}, {500, "a", []float64{4}, nil}} {
+		b.rows = append(b.rows, kdb.NewList(kdb.Symbol(m.Tag), kdb.Long(m.Time), kdb.Atom(kdb.KF, m.Values)))
+	}
+
+	g.add("shard0", backendReplica, b)
+	g.add("shard1", backendPrimary, batch{rows: b.rows[1:2]})
+
+	expected := []gap{
+		{"shard0", backendReplica, "a", 200, 500, 3},
+		{"shard0", backendReplica, "b", 100, 100, 1},
+		{"shard1", backendPrimary, "b", 100, 100, 1},
+	}
+
+	var out bytes.Buffer
+
+	db := KDB{state: &kdbState{gaps: g}}
+
+	assert.NoError(t, db.catchUp(false, &out))
+	assert.Equal(t, "shard0\treplica\ta\t200\t500\t3\nshard0\treplica\tb\t100\t100\t1\nshard1\tprimary\tb\t100\t100\t1\n3 gaps\n", out.String())
+
+	gaps, err := g.take()
+
+	assert.NoError(t, err)
+	assert.Equal(t, expected, gaps)
+
+	gaps, err = g.take()
+
+	assert.NoError(t, err)
+	assert.Empty(t, gaps, "taken gaps shouldn't be returned again")
+
+	files, _ := ioutil.ReadDir(dir)
+
+	assert.Empty(t, files, "taken log should be removed")
+}
+
+func TestReplicationConfig(t *testing.T) {
+	_, err := loadConfig([]string{"-replica.tp.host", "127.0.0.1", "-replica.tp.port", "6012", "-replica.hdb.host", "127.0.0.1", "-replica.hdb.port", "6013", "-replication.ack", "all"})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `shard "shard0" replica should be a different tp and hdb`)
+	assert.Contains(t, err.Error(), `replication.ack "all" should be one or both`)
+
+	_, err = loadConfig([]string{"-replica.tp.host", "10.0.0.2", "-replica.tp.port", "6012", "-replica.hdb.host", "10.0.0.2"})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "replica.hdb.port 0 is out of range")
+
+	c, err := loadConfig([]string{"-replica.tp.host", "10.0.0.2", "-replica.tp.port", "6012", "-replica.hdb.host", "10.0.0.2", "-replica.hdb.port", "6013", "-replication.ack", "one"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, kdbAddr{"10.0.0.2", 6012}, c.shards()[0].Replica.TP, "default shard should get the replica")
+}
+
+func TestResendUnjournaledBatches(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0")
+	shard := shards["shard0"]
+
+	in := db.startQueueConsumer()
+
+	// tp journals the first batch, but the connection breaks before the
+	// acknowledgement
+	shard.store.mu.Lock()
+	shard.store.dropAfter = 1
+	shard.store.mu.Unlock()
+
+	in <- Msg{1000, "a", []float64{1}, nil}
+
+	shard.store.waitRows(t, 1)
+
+	// tp crashes before journaling the second one
+	shard.store.mu.Lock()
+	shard.store.dropBefore = 1
+	shard.store.mu.Unlock()
+
+	in <- Msg{2000, "a", []float64{2}, nil}
+
+	shard.store.waitRows(t, 2)
+
+	close(in)
+	db.state.saved.Wait()
+
+	assert.Equal(t, Samples{{1000, []float64{1}, nil}, {2000, []float64{2}, nil}}, shard.store.samples("a"), "each batch should be saved once")
+	assert.Equal(t, 3, shard.tp.callsOf(".P.tp_save"), "only the batch missing in the journal should be resent")
+	assert.Equal(t, int64(2), shard.store.seqs[db.source(0).Data.(string)])
+
+	// a restarted app continues the journal's sequence
+	restarted := newKDB([]shardConfig{{Name: "shard0", TP: shard.tp.addr(), HDB: shard.hdb.addr()}})
+
+	assert.Equal(t, db.state.seqs, restarted.state.seqs)
+
+	// another instance sharing tp numbers its batches on its own
+	restarted.state.instance, restarted.state.seqs[0] = "other", 0
+	restarted.send(0, batch{rows: []*kdb.K{kdb.NewList(kdb.Symbol("a"), kdb.Long(3000), kdb.Atom(kdb.KF, []float64{3}))}})
+
+	assert.Len(t, shard.store.samples("a"), 3, "other instances' batches shouldn't be skipped")
+}
+
+func TestAckOneDoesntWaitForHungReplica(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "poc-gaps")
+	defer os.RemoveAll(dir)
+
+	defer func(r replicationConfig) { conf.Replication = r }(conf.Replication)
+
+	defer func(b batchConfig) { conf.Batch = b }(conf.Batch)
+
+	conf.Replication = replicationConfig{Ack: "one", GapLog: filepath.Join(dir, "gaps.jsonl"), Timeout: 500 * time.Millisecond}
+	conf.Batch.MaxAge = 10 * time.Millisecond
+
+	primary, replica := newFakeStore(), newFakeStore()
+	replica.hang = make(chan struct{})
+	defer close(replica.hang)
+
+	tp, hdb := newFakeKDB(t, primary.call), newFakeKDB(t, primary.call)
+	rtp, rhdb := newFakeKDB(t, replica.call), newFakeKDB(t, replica.call)
+
+	db := newKDB([]shardConfig{{Name: "shard0", TP: tp.addr(), HDB: hdb.addr(), Replica: replicaConfig{rtp.addr(), rhdb.addr()}}})
+
+	in := db.startQueueConsumer()
+	s := time.Now()
+
+	in <- Msg{1000, "a", []float64{1}, nil}
+
+	primary.waitRows(t, 1)
+
+	// the replica is still saving the first batch
+	in <- Msg{2000, "a", []float64{2}, nil}
+
+	primary.waitRows(t, 2)
+
+	assert.True(t, time.Since(s) < conf.Replication.Timeout, "batches shouldn't wait for the hung replica")
+
+	close(in)
+	db.state.saved.Wait()
+
+	assert.True(t, time.Since(s) >= conf.Replication.Timeout, "the replica call should time out in the background")
+
+	gaps, err := db.state.gaps.take()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []gap{{"shard0", backendReplica, "a", 2000, 2000, 1}, {"shard0", backendReplica, "a", 1000, 1000, 1}}, gaps, "both batches should be logged as replica gaps")
+	assert.Empty(t, replica.samples("a"))
+}
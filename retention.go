@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// pruner drops expired rows each `retention.interval`: date partitions,
+// that only hold expired rows, and rows of tags, that expired in partitions
+// other tags keep. a tag's retention is its first matching rule's, its
+// tenant's or `retention.default`, and the cutoff is truncated to
+// `retention.step`, so reads skip expired rows, that are still on disk, in
+// steps, see expiredBefore
+type pruner struct {
+	db      Database
+	c       retentionConfig
+	tenants map[string]tenantConfig
+	// 1 while a run is in progress, runs never overlap
+	running int32
+
+	mu     sync.Mutex
+	status pruneStatus
+}
+
+// pruneStatus of the last finished run, and of the current one, if any,
+// served on `GET /admin/retention`
+type pruneStatus struct {
+	Running   bool      `json:"running"`
+	LastStart time.Time `json:"lastStart"`
+	LastEnd   time.Time `json:"lastEnd"`
+	Duration  string    `json:"duration"`
+	NextRun   time.Time `json:"nextRun"`
+	// tags checked, partitions and rows dropped by the last run
+	Tags       int   `json:"tags"`
+	Partitions int   `json:"partitions"`
+	Rows       int64 `json:"rows"`
+	// rows dropped by all runs since start
+	TotalRows int64  `json:"totalRows"`
+	Errors    int    `json:"errors"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// retention is the pruner of `conf`, set at startup. reads take cutoffs
+// of its rules
+var retention = newPruner(nil, conf.Retention, conf.Tenants)
+
+func newPruner(db Database, c retentionConfig, tenants []tenantConfig) *pruner {
+	return &pruner{db: db, c: c, tenants: tenantMap(tenants)}
+}
+
+// expiredBefore is the retention cutoff of stored `tag` now: reads skip its
+// rows before it, as they're only dropped once the cutoff passes the end of
+// their partition. 0 if the tag is kept forever
+func expiredBefore(tag string) int64 {
+	return retention.cutoff(tag, time.Now())
+}
+
+// retentionOf stored `tag`, 0 if it's kept forever
+func (p *pruner) retentionOf(tag string) time.Duration {
+	for _, r := range p.c.Rules {
+		if ok, _ := path.Match(r.Pattern, tag); ok {
+			return r.Keep
+		}
+	}
+
+	tenant, _ := splitTag(tag)
+
+	if t, ok := p.tenants[tenant]; ok && t.Retention > 0 {
+		return t.Retention
+	}
+
+	return p.c.Default
+}
+
+// cutoff of stored `tag` at `now`: its rows before it are expired. 0 if the
+// tag is kept forever
+func (p *pruner) cutoff(tag string, now time.Time) int64 {
+	keep := p.retentionOf(tag)
+
+	if keep == 0 {
+		return 0
+	}
+
+	return now.Add(-keep).Truncate(p.c.Step).UnixNano()
+}
+
+// run prunes all stored tags, returns false if another run is in progress
+func (p *pruner) run(now time.Time) bool {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		return false
+	}
+
+	defer atomic.StoreInt32(&p.running, 0)
+
+	s := time.Now()
+
+	p.mu.Lock()
+	p.status.Running, p.status.LastStart = true, s
+	p.mu.Unlock()
+
+	st := pruneStatus{LastStart: s}
+
+	tags, err := p.db.getTags()
+
+	if err != nil {
+		st.Errors, st.LastError = 1, "can't list tags: "+err.Error()
+	}
+
+	st.Tags = len(tags)
+
+	partitions, rows, err := p.db.prune(func(tag string) int64 { return p.cutoff(tag, now) })
+
+	st.Partitions, st.Rows = partitions, int64(rows)
+
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+		pruneRuns.inc("error")
+		logger.error("can't drop expired rows", "dropped", partitions, "error", err)
+	}
+
+	prunedRows.add(uint64(st.Rows))
+
+	if st.Errors == 0 {
+		pruneRuns.inc("ok")
+	}
+
+	p.mu.Lock()
+	st.LastEnd, st.Duration = time.Now(), time.Now().Sub(s).String()
+	st.NextRun, st.TotalRows = p.status.NextRun, p.status.TotalRows+st.Rows
+	p.status = st
+	p.mu.Unlock()
+
+	if st.Rows > 0 || st.Errors > 0 {
+		logger.info("prune done", "tags", st.Tags, "partitions", st.Partitions, "rows", st.Rows, "errors", st.Errors, "duration", st.Duration)
+	} else {
+		logger.debug("prune done, nothing expired", "tags", st.Tags, "duration", st.Duration)
+	}
+
+	return true
+}
+
+// schedule runs prunes each `retention.interval`. runs forever, meant to be
+// started in a goroutine
+func (p *pruner) schedule() {
+	t := time.NewTicker(p.c.Interval)
+
+	for {
+		p.mu.Lock()
+		p.status.NextRun = time.Now().Add(p.c.Interval)
+		p.mu.Unlock()
+
+		now := <-t.C
+
+		if !p.run(now) {
+			logger.warn("previous prune is still running, skipping", "interval", p.c.Interval)
+		}
+	}
+}
+
+func (p *pruner) getStatus() pruneStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.status
+}
+
+// `GET /admin/retention` returns prune status, `POST` starts a prune now,
+// responding with 202, or with 409 if one is in progress
+func retentionHandler(p *pruner, ctx *fasthttp.RequestCtx) {
+	if p == nil {
+		ctx.Error("retention is disabled", fasthttp.StatusNotFound)
+		return
+	}
+
+	if ctx.IsPost() {
+		if atomic.LoadInt32(&p.running) == 1 {
+			ctx.Error("prune is in progress", fasthttp.StatusConflict)
+			return
+		}
+
+		go p.run(time.Now())
+
+		ctx.SetStatusCode(fasthttp.StatusAccepted)
+	}
+
+	respJS, _ := json.Marshal(p.getStatus())
+
+	ctx.SetContentType("application/json")
+	ctx.Write(respJS)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+	"github.com/tidwall/gjson"
+)
+
+// memDB keeps sorted timestamps of each tag, and drops their date
+// partitions like `.P.drop_date`, or their rows of a partition like
+// `.P.prune_tag`
+type memDB struct {
+	mockDB
+	mu   sync.Mutex
+	rows map[string][]int64
+}
+
+func (db *memDB) add(tag string, ts int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	rows := db.rows[tag]
+	i := sort.Search(len(rows), func(i int) bool { return rows[i] > ts })
+
+	rows = append(rows, 0)
+	copy(rows[i+1:], rows[i:])
+	rows[i] = ts
+
+	db.rows[tag] = rows
+}
+
+func (db *memDB) getTags() ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var tags []string
+
+	for tag := range db.rows {
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+func (db *memDB) prune(cutoff func(string) int64) (int, int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	day := int64(24 * time.Hour)
+	expired := make(map[int64]bool)
+
+	for tag, rows := range db.rows {
+		c := cutoff(tag)
+
+		for _, ts := range rows {
+			d := bucketOf(ts, day)
+			e, seen := expired[d]
+			expired[d] = (e || !seen) && c != 0 && c >= d+day
+		}
+	}
+
+	partitions, n := 0, 0
+
+	for _, e := range expired {
+		if e {
+			partitions++
+		}
+	}
+
+	for tag, rows := range db.rows {
+		c := cutoff(tag)
+
+		var kept []int64
+
+		for _, ts := range rows {
+			if c == 0 || c < bucketOf(ts, day)+day {
+				kept = append(kept, ts)
+			}
+		}
+
+		n += len(rows) - len(kept)
+		db.rows[tag] = kept
+	}
+
+	return partitions, n, nil
+}
+
+func testRetention() retentionConfig {
+	c := defaultConfig().Retention
+	c.Default = time.Hour
+	c.Step = time.Minute
+	c.Rules = []retentionRule{{"debug.*", 10 * time.Minute}, {"acme:debug.*", time.Hour}}
+
+	return c
+}
+
+func TestRetentionOf(t *testing.T) {
+	p := newPruner(mockDB{}, testRetention(), []tenantConfig{{Name: "acme", Retention: 30 * time.Minute}, {Name: "globex"}})
+
+	assert.Equal(t, 10*time.Minute, p.retentionOf("debug.1"), "rule should match")
+	assert.Equal(t, time.Hour, p.retentionOf("acme:debug.1"), "rule should win over tenant retention")
+	assert.Equal(t, 30*time.Minute, p.retentionOf("acme:sensor.1"), "tenant retention should apply")
+	assert.Equal(t, time.Hour, p.retentionOf("globex:sensor.1"), "tenants without retention get default")
+	assert.Equal(t, time.Hour, p.retentionOf("sensor.1"))
+
+	now := time.Date(2017, 5, 1, 12, 30, 45, 0, time.UTC)
+
+	assert.Equal(t, time.Date(2017, 5, 1, 12, 20, 0, 0, time.UTC).UnixNano(), p.cutoff("debug.1", now), "cutoff should be truncated to a step")
+
+	p.c.Default = 0
+
+	assert.Equal(t, int64(0), p.cutoff("sensor.1", now), "tags should be kept forever without retention")
+}
+
+func TestPruneConcurrentIngest(t *testing.T) {
+	db := &memDB{rows: make(map[string][]int64)}
+	p := newPruner(db, testRetention(), []tenantConfig{{Name: "acme", Retention: 30 * time.Minute}})
+
+	// rows of the last 2h, an hour and a half of them after midnight
+	base := time.Date(2017, 5, 2, 1, 30, 0, 0, time.UTC)
+	midnight := time.Date(2017, 5, 2, 0, 0, 0, 0, time.UTC).UnixNano()
+	tags := []string{"t0", "t1", "t2", "debug.1", "acme:x", "acme:debug.1"}
+
+	var ingest, prunes sync.WaitGroup
+
+	// (tag index; ts) pairs, written by each ingest goroutine
+	written := make([][]int64, 4)
+	stop := make(chan bool)
+
+	for w := range written {
+		ingest.Add(1)
+
+		go func(w int) {
+			defer ingest.Done()
+
+			r := rand.New(rand.NewSource(int64(w)))
+
+			for i := 0; i < 3000; i++ {
+				ts := base.Add(-time.Duration(r.Int63n(int64(2 * time.Hour)))).UnixNano()
+				tag := r.Intn(len(tags))
+
+				db.add(tags[tag], ts)
+				written[w] = append(written[w], int64(tag), ts)
+			}
+		}(w)
+	}
+
+	for g := 0; g < 2; g++ {
+		prunes.Add(1)
+
+		go func() {
+			defer prunes.Done()
+
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				p.run(base.Add(time.Duration(i%5) * time.Minute))
+			}
+		}()
+	}
+
+	ingest.Wait()
+	close(stop)
+	prunes.Wait()
+
+	end := base.Add(5 * time.Minute)
+
+	assert.True(t, p.run(end))
+
+	expected := make(map[string]int)
+	dropped := int64(0)
+
+	// all tags' cutoffs are after midnight, so the day before is dropped
+	for _, w := range written {
+		for i := 0; i < len(w); i += 2 {
+			if w[i+1] >= midnight {
+				expected[tags[w[i]]]++
+			} else {
+				dropped++
+			}
+		}
+	}
+
+	for _, tag := range tags {
+		rows := db.rows[tag]
+
+		assert.Len(t, rows, expected[tag], "%s should keep rows of unexpired partitions", tag)
+
+		if len(rows) > 0 {
+			assert.True(t, rows[0] >= midnight, "%s shouldn't have rows of expired partitions", tag)
+		}
+	}
+
+	assert.Equal(t, dropped, p.getStatus().TotalRows, "every dropped row should be counted")
+	assert.Equal(t, len(tags), p.getStatus().Tags)
+}
+
+func TestRetentionAdmin(t *testing.T) {
+	db := mockDB{}
+	p := newPruner(db, defaultConfig().Retention, nil)
+
+	c := getServer(db, newIntake(db.startQueueConsumer()), nil, nil, nil, p).c
+
+	status, body, err := c.Get(nil, "http://test.me/admin/retention")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 200, status)
+	assert.False(t, gjson.GetBytes(body, "running").Bool())
+
+	assert.Equal(t, 202, doWithKey(c, "POST", "http://test.me/admin/retention", "", ""))
+
+	for i := 0; i < 100 && p.getStatus().LastEnd.IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, body, _ = c.Get(nil, "http://test.me/admin/retention")
+
+	assert.Equal(t, int64(6), gjson.GetBytes(body, "tags").Int(), "all tags should be checked")
+	assert.Equal(t, int64(0), gjson.GetBytes(body, "rows").Int(), "nothing expires without retention")
+}
+
+func TestDropExpiredPartitions(t *testing.T) {
+	defer func(p *pruner) { retention = p }(retention)
+
+	c := testRetention()
+	c.Default, c.Rules = 0, []retentionRule{{"a", time.Minute}}
+
+	db, shards := getFakeKDB(t, "shard0")
+	store := shards["shard0"].store
+
+	// a's cutoff is after midnight, even right after it
+	day, now := int64(24*time.Hour), time.Now().UnixNano()
+
+	if m := bucketOf(now, day) + 2*int64(time.Minute); now < m {
+		now = m
+	}
+
+	yesterday := bucketOf(now, day) - day
+
+	store.mu.Lock()
+	store.add(kdb.NewList(append(sampleRows("a", Samples{{yesterday - 1, []float64{1}, nil}, {yesterday + 1, []float64{2}, nil}, {now - 1, []float64{3}, nil}}), sampleRows("b", Samples{{yesterday + 2, []float64{4}, nil}})...)...))
+	store.mu.Unlock()
+
+	retention = newPruner(db, c, nil)
+	p := retention
+
+	assert.True(t, p.run(time.Unix(0, now)))
+	assert.Equal(t, 1, p.getStatus().Partitions, "only the day without unexpired tags should be dropped")
+	assert.Equal(t, int64(2), p.getStatus().Rows)
+	assert.Equal(t, Samples{{now - 1, []float64{3}, nil}}, store.samples("a"), "expired rows should be dropped from a partition, that other tags keep")
+	assert.Len(t, store.samples("b"), 1, "tags, that didn't expire, should keep their rows")
+
+	assert.True(t, p.run(time.Unix(0, now)))
+	assert.Equal(t, int64(0), p.getStatus().Rows, "prunes should be idempotent")
+
+	rows, _ := db.exportSeries("a", yesterday-day, now)
+
+	assert.Equal(t, Samples{{now - 1, []float64{3}, nil}}, rows, "reads should skip expired rows")
+
+	res, _ := db.getSeries("a", now-2*time.Hour.Nanoseconds(), now)
+
+	for _, s := range res.Samples {
+		assert.Equal(t, []float64{3}, s.Values, "expired rows shouldn't be looked back to")
+	}
+}
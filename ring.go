@@ -0,0 +1,82 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// points of each shard on the ring, more points spread tags more evenly
+const ringReplicas = 128
+
+// ring is a consistent hash ring of shard names. adding a shard only moves
+// the tags, that hash between the new shard's points and their
+// predecessors, roughly 1/N of them
+type ring struct {
+	points []uint64
+	shards []int
+	// shard names, by index
+	names []string
+}
+
+// hash64 is FNV-64a with murmur3 finalizer: FNV alone clusters similar
+// short strings, like point names, on the ring
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
+
+// newRing places `ringReplicas` points of each shard by its name, so the
+// ring doesn't depend on the order of shards in config
+func newRing(names []string) *ring {
+	r := &ring{names: names}
+
+	type point struct {
+		hash  uint64
+		shard int
+	}
+
+	var points []point
+
+	for i, name := range names {
+		for j := 0; j < ringReplicas; j++ {
+			points = append(points, point{hash64(name + "#" + strconv.Itoa(j)), i})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.shards = append(r.shards, p.shard)
+	}
+
+	return r
+}
+
+// shard, that owns `tag`: the first point clockwise of the tag's hash
+func (r *ring) shard(tag string) int {
+	if len(r.shards) == 1 || len(r.points) == 0 {
+		return 0
+	}
+
+	h := hash64(tag)
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.shards[i]
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+func TestRingSpread(t *testing.T) {
+	r := newRing([]string{"shard0", "shard1", "shard2", "shard3"})
+
+	counts := make([]int, 4)
+
+	for i := 0; i < 100000; i++ {
+		counts[r.shard(fmt.Sprintf("tag%d", i))]++
+	}
+
+	for s, n := range counts {
+		assert.InDelta(t, 25000, n, 5000, "shard %d should get about a quarter of tags", s)
+	}
+}
+
+func TestRingAddShard(t *testing.T) {
+	before := newRing([]string{"shard0", "shard1", "shard2"})
+	after := newRing([]string{"shard0", "shard1", "shard2", "shard3"})
+	reordered := newRing([]string{"shard3", "shard2", "shard1", "shard0"})
+
+	names := []string{"shard0", "shard1", "shard2", "shard3"}
+	reorderedNames := []string{"shard3", "shard2", "shard1", "shard0"}
+
+	moved := 0
+
+	for i := 0; i < 100000; i++ {
+		tag := fmt.Sprintf("tag%d", i)
+
+		if before.shard(tag) != after.shard(tag) {
+			moved++
+			assert.Equal(t, 3, after.shard(tag), "tags should only move to the new shard")
+		}
+
+		assert.Equal(t, names[after.shard(tag)], reorderedNames[reordered.shard(tag)], "order of shards shouldn't matter")
+	}
+
+	assert.InDelta(t, 25000, moved, 5000, "about 1/N of tags should move")
+
+	assert.Equal(t, 0, newRing([]string{"shard0"}).shard("tag1"))
+}
+
+func TestRebalancePlan(t *testing.T) {
+	r := newRing([]string{"shard0", "shard1"})
+
+	var tags []string
+
+	for i := 0; i < 100; i++ {
+		tags = append(tags, fmt.Sprintf("tag%d", i))
+	}
+
+	// all tags are on shard0, before shard1 was added
+	moves := rebalancePlan(r, [][]string{tags, nil})
+
+	assert.NotEmpty(t, moves)
+
+	for _, m := range moves {
+		assert.Equal(t, 0, m.from)
+		assert.Equal(t, 1, m.to)
+		assert.Equal(t, 1, r.shard(m.tag))
+	}
+
+	assert.Len(t, moves, len(tags)-len(rebalancePlan(newRing([]string{"shard0", "shard1"}), [][]string{nil, tags})), "each tag should be on one of the shards")
+}
+
+func TestRebalanceMovesTags(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0", "shard1")
+
+	var rows []*kdb.K
+
+	for i := 0; i < 20; i++ {
+		tag := fmt.Sprintf("tag%d", i)
+		rows = append(rows, sampleRows(tag, Samples{{1000, []float64{1}, nil}, {2000, []float64{2}, nil}})...)
+	}
+
+	// all tags are on shard0, before shard1 was added
+	shards["shard0"].store.add(kdb.NewList(rows...))
+
+	var out bytes.Buffer
+
+	assert.NoError(t, db.rebalance(true, &out))
+	assert.Contains(t, out.String(), "\tshard0\tshard1\n")
+
+	for i := 0; i < 20; i++ {
+		tag := fmt.Sprintf("tag%d", i)
+		owner, other := shards["shard0"], shards["shard1"]
+
+		if db.ring.shard(tag) == 1 {
+			owner, other = other, owner
+		}
+
+		assert.Len(t, owner.store.samples(tag), 2, "%s should be on its owner", tag)
+		assert.Empty(t, other.store.samples(tag), "%s should be dropped from the old shard", tag)
+	}
+}
+
+// a move, that failed after the copy, can be run again, without copying
+// rows twice
+func TestRebalanceRerun(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0", "shard1")
+
+	var tag string
+
+	for i := 0; db.ring.shard(tag) != 1; i++ {
+		tag = fmt.Sprintf("tag%d", i)
+	}
+
+	rows := sampleRows(tag, Samples{{1000, []float64{1}, nil}, {2000, []float64{2}, nil}})
+
+	// the owner already got a new message
+	shards["shard1"].store.add(kdb.NewList(sampleRows(tag, Samples{{3000, []float64{3}, nil}})...))
+	shards["shard0"].store.add(kdb.NewList(rows...))
+
+	assert.NoError(t, db.rebalance(true, &bytes.Buffer{}))
+
+	// the first run copied the rows, but failed before the drop
+	shards["shard0"].store.add(kdb.NewList(rows...))
+
+	assert.NoError(t, db.rebalance(true, &bytes.Buffer{}))
+
+	assert.Equal(t, Samples{{1000, []float64{1}, nil}, {2000, []float64{2}, nil}, {3000, []float64{3}, nil}}, shards["shard1"].store.samples(tag), "rows shouldn't be copied twice")
+	assert.Empty(t, shards["shard0"].store.samples(tag))
+}
+
+func TestRebalanceWaitsForRefresh(t *testing.T) {
+	db, shards := getFakeKDB(t, "shard0", "shard1")
+	store := shards["shard1"].store
+
+	// shard1's hdb didn't load the flush yet
+	store.mu.Lock()
+	store.visible = 1
+	store.mu.Unlock()
+
+	var tag string
+
+	for i := 0; db.ring.shard(tag) != 1; i++ {
+		tag = fmt.Sprintf("tag%d", i)
+	}
+
+	shards["shard0"].store.add(kdb.NewList(sampleRows(tag, Samples{{1000, []float64{1}, nil}})...))
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- db.rebalance(true, &bytes.Buffer{})
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("the tag shouldn't be dropped before hdb loaded it: %v", err)
+	case <-time.After(3 * visiblePoll):
+	}
+
+	store.mu.Lock()
+	store.visible = 0
+	store.mu.Unlock()
+
+	assert.NoError(t, <-done)
+	assert.Empty(t, shards["shard0"].store.samples(tag), "the tag should be dropped, once hdb loaded it")
+}
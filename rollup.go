@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	kdb "github.com/sv/kdbgo"
+)
+
+// tier of pre-aggregated rollups of a tag, stored in its partition as
+// `name` table next to raw rows in `t`
+type tier struct {
+	name  string
+	width time.Duration
+}
+
+// rollup tiers, from the finest
+var tiers = []tier{{"r1s", time.Second}, {"r1m", time.Minute}, {"r1h", time.Hour}}
+
+// tierFor returns the coarsest tier, that has buckets no wider than
+// `bucket` ns, nil if raw rows are needed
+func tierFor(bucket int64) *tier {
+	var best *tier
+
+	for i := range tiers {
+		if int64(tiers[i].width) <= bucket {
+			best = &tiers[i]
+		}
+	}
+
+	return best
+}
+
+// rollup aggregates rows of a tag in the bucket starting at `ts`. values
+// are aggregated by index, over the rows that have it, skipping NaNs like
+// q's aggregates skip nulls. typed values are only kept as the last one,
+// ints are aggregated as floats, bools and strings as nulls. each batch adds
+// partial rollups, `.P.merge_rollup` merges them on reads, so late rows
+// and rows of the same bucket in later batches are accounted for
+type rollup struct {
+	tag string
+	ts  int64
+	// timestamp and values cell of the newest row
+	lts  int64
+	last *kdb.K
+	min  []float64
+	max  []float64
+	sum  []float64
+	n    int64
+}
+
+func (r *rollup) add(ts int64, cell *kdb.K) {
+	if r.n == 0 || ts >= r.lts {
+		r.lts, r.last = ts, cell
+	}
+
+	vals, typed, _ := cellValues(cell)
+
+	if typed != nil {
+		vals = make([]float64, len(typed))
+
+		for i, v := range typed {
+			vals[i] = math.NaN()
+
+			switch v := v.(type) {
+			case float64:
+				vals[i] = v
+			case int64:
+				vals[i] = float64(v)
+			}
+		}
+	}
+
+	for i, v := range vals {
+		if i >= len(r.sum) {
+			r.min, r.max, r.sum = append(r.min, v), append(r.max, v), append(r.sum, v)
+			continue
+		}
+
+		if v < r.min[i] || math.IsNaN(r.min[i]) {
+			r.min[i] = v
+		}
+
+		if v > r.max[i] || math.IsNaN(r.max[i]) {
+			r.max[i] = v
+		}
+
+		if math.IsNaN(r.sum[i]) {
+			r.sum[i] = v
+		} else if !math.IsNaN(v) {
+			r.sum[i] += v
+		}
+	}
+
+	r.n++
+}
+
+// `(tag; ts; lts; lval; lo; hi; tot; cnt)` row of `.P.gen_rl` table
+func (r *rollup) row() *kdb.K {
+	return kdb.NewList(kdb.Symbol(r.tag), kdb.Long(r.ts), kdb.Long(r.lts), r.last, kdb.Atom(kdb.KF, r.min), kdb.Atom(kdb.KF, r.max), kdb.Atom(kdb.KF, r.sum), kdb.Long(r.n))
+}
+
+// bucketOf is the start of `width` bucket of `ts`, rounding down for
+// negative timestamps too
+func bucketOf(ts int64, width int64) int64 {
+	b := ts - ts%width
+
+	if ts < 0 && b != ts {
+		b -= width
+	}
+
+	return b
+}
+
+// rollups of `(tag; ts; values)` rows in `width` buckets, in order of
+// their first row
+func rollups(rows []*kdb.K, width int64) []*rollup {
+	type key struct {
+		tag string
+		ts  int64
+	}
+
+	byKey := make(map[key]*rollup)
+
+	var list []*rollup
+
+	for _, row := range rows {
+		cols := row.Data.([]*kdb.K)
+		tag, ts := cols[0].Data.(string), cols[1].Data.(int64)
+
+		k := key{tag, bucketOf(ts, int64(width))}
+
+		r, ok := byKey[k]
+
+		if !ok {
+			r = &rollup{tag: k.tag, ts: k.ts}
+			byKey[k] = r
+			list = append(list, r)
+		}
+
+		r.add(ts, cols[2])
+	}
+
+	return list
+}
+
+// rollupTiers is a list of rollup rows of each tier, for `.P.tp_save`
+func rollupTiers(rows []*kdb.K) *kdb.K {
+	lists := make([]*kdb.K, len(tiers))
+
+	for i, t := range tiers {
+		var tierRows []*kdb.K
+
+		for _, r := range rollups(rows, int64(t.width)) {
+			tierRows = append(tierRows, r.row())
+		}
+
+		lists[i] = kdb.NewList(tierRows...)
+	}
+
+	return kdb.NewList(lists...)
+}
+
+// backfill prints stored tags of each shard to `w`, and with `apply`,
+// rebuilds their rollups from raw rows on the shard's tp and its replica,
+// e.g. for partitions written before rollups were added
+func (db KDB) backfill(apply bool, w io.Writer) error {
+	total := 0
+
+	for shard := range db.hdb {
+		tags, err := db.shardTags(shard)
+
+		if err != nil {
+			return fmt.Errorf("can't list tags of %s: %v", db.hdb[shard].name, err)
+		}
+
+		for _, tag := range tags {
+			total++
+
+			if !apply {
+				fmt.Fprintf(w, "%s\t%s\n", tag, db.shardName(shard))
+				continue
+			}
+
+			for _, tp := range db.writers(shard * conf.Batch.Workers) {
+				res, err := tp.call(".P.backfill_tag", kdb.Symbol(tag))
+
+				if err != nil {
+					return fmt.Errorf("can't backfill %s on %s: %v", tag, tp.name, err)
+				}
+
+				fmt.Fprintf(w, "%s\t%s\t%v rows\n", tag, tp.name, res.Data)
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%d tags\n", total)
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+func TestTierFor(t *testing.T) {
+	assert.Nil(t, tierFor(int64(500*time.Millisecond)), "short buckets need raw rows")
+	assert.Equal(t, "r1s", tierFor(int64(time.Second)).name)
+	assert.Equal(t, "r1s", tierFor(int64(59*time.Second)).name)
+	assert.Equal(t, "r1m", tierFor(int64(time.Minute)).name)
+	assert.Equal(t, "r1h", tierFor(int64(24*time.Hour)).name, "coarsest tier should be picked")
+}
+
+func TestRollups(t *testing.T) {
+	row := func(tag string, ts int64, vals ...float64) *kdb.K {
+		return kdb.NewList(kdb.Symbol(tag), kdb.Long(ts), kdb.Atom(kdb.KF, vals))
+	}
+
+	s := int64(time.Second)
+
+	rs := rollups([]*kdb.K{
+		row("a", 2*s+500, 3, 10),
+		row("a", 2*s+100, 1, 20),
+		row("b", 2*s, 7),
+		row("a", 2*s+300, 2),
+		row("a", 3*s, 5, 5),
+	}, s)
+
+	assert.Len(t, rs, 3)
+
+	a := rs[0]
+
+	assert.Equal(t, "a", a.tag)
+	assert.Equal(t, 2*s, a.ts)
+	assert.Equal(t, 2*s+500, a.lts)
+	assert.Equal(t, []float64{3, 10}, a.last.Data, "last should be the newest row, not the last added")
+	assert.Equal(t, []float64{1, 10}, a.min)
+	assert.Equal(t, []float64{3, 20}, a.max)
+	assert.Equal(t, []float64{6, 30}, a.sum, "values should be aggregated over rows that have them")
+	assert.Equal(t, int64(3), a.n)
+
+	nan := rollups([]*kdb.K{row("c", s, math.NaN(), 1), row("c", s+1, 2, math.NaN()), row("c", s+2, 4, 3)}, s)[0]
+
+	assert.Equal(t, []float64{2, 1}, nan.min, "nulls should be skipped")
+	assert.Equal(t, []float64{4, 3}, nan.max)
+	assert.Equal(t, []float64{6, 4}, nan.sum)
+
+	assert.Equal(t, "b", rs[1].tag)
+	assert.Equal(t, 3*s, rs[2].ts)
+
+	assert.Equal(t, int64(-s), bucketOf(-1, s), "negative timestamps should be rounded down")
+	assert.Equal(t, int64(-s), bucketOf(-s, s))
+
+	tiersRow := rollupTiers([]*kdb.K{row("a", 2*s, 1)}).Data.([]*kdb.K)
+
+	assert.Len(t, tiersRow, len(tiers), "each tier should get its rows")
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mailru/easyjson"
+	"github.com/valyala/fasthttp"
+)
+
+// value types of schema fields
+var valueTypes = map[string]bool{"float": true, "int": true, "bool": true, "string": true}
+
+// schemaOf stored `tag` is the first matching one, nil if there's none
+func schemaOf(tag string) *schemaConfig {
+	for i, s := range conf.Schemas {
+		if ok, _ := path.Match(s.Pattern, tag); ok {
+			return &conf.Schemas[i]
+		}
+	}
+
+	return nil
+}
+
+// fieldsOf stored `tag`: names of its value indexes, nil if it has no
+// schema
+func fieldsOf(tag string) []string {
+	if s := schemaOf(tag); s != nil {
+		return s.Fields
+	}
+
+	return nil
+}
+
+// typesOf stored `tag`: types of its value indexes, nil if they're all
+// floats
+func typesOf(tag string) []string {
+	s := schemaOf(tag)
+
+	if s == nil {
+		return nil
+	}
+
+	types := s.Types
+
+	if len(types) == 1 {
+		types = make([]string, len(s.Fields))
+
+		for i := range types {
+			types[i] = s.Types[0]
+		}
+	}
+
+	for _, t := range types {
+		if t != "float" {
+			return types
+		}
+	}
+
+	return nil
+}
+
+// namedMsg is a message with values keyed by field name of its tag's
+// schema. `/save` accepts it, and `/export` writes rows of tags with a
+// schema as it
+type namedMsg struct {
+	Time   int64                  `json:"time"`
+	Tag    string                 `json:"tag"`
+	Values map[string]interface{} `json:"values"`
+}
+
+// rawMsg is a message with values not decoded yet, as they're decoded by
+// the schema of its stored tag
+type rawMsg struct {
+	Time   int64           `json:"time"`
+	Tag    string          `json:"tag"`
+	Values json.RawMessage `json:"values"`
+}
+
+// decodeMsg decodes a `/save` message. easyjson decodes ones with arrays of
+// floats, values of others aren't `decoded`, and typeValues decodes them,
+// once the stored tag is known
+func decodeMsg(body []byte) (Msg, bool, error) {
+	var m Msg
+
+	if err := easyjson.Unmarshal(body, &m); err == nil {
+		return m, true, nil
+	}
+
+	var raw rawMsg
+
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return m, false, err
+	}
+
+	if raw.Values == nil {
+		return m, false, fmt.Errorf("message has no 'values'")
+	}
+
+	return Msg{Time: raw.Time, Tag: raw.Tag}, false, nil
+}
+
+// typeValues decodes values of message `body` into `m`, by the schema of its
+// stored tag, unless easyjson `decoded` them, and they're all floats.
+// values are an array, or an object keyed by field name, nulls and missing
+// fields are NaN, or nil for typed tags. errors are returned with the
+// reason to reject the message for
+func typeValues(m *Msg, body []byte, decoded bool) (string, error) {
+	types := typesOf(m.Tag)
+
+	if decoded && types == nil {
+		return "", nil
+	}
+
+	var raw rawMsg
+
+	json.Unmarshal(body, &raw)
+
+	fields := fieldsOf(m.Tag)
+
+	var vals []json.RawMessage
+
+	if err := json.Unmarshal(raw.Values, &vals); err != nil {
+		var named map[string]json.RawMessage
+
+		if json.Unmarshal(raw.Values, &named) != nil {
+			return "decode", fmt.Errorf("'values' should be an array or an object")
+		}
+
+		if fields == nil {
+			return "fields", fmt.Errorf("tag has no schema, 'values' should be an array")
+		}
+
+		vals = make([]json.RawMessage, len(fields))
+
+		for name, v := range named {
+			i := indexOf(fields, name)
+
+			if i < 0 {
+				return "fields", fmt.Errorf("unknown field %q, tag's fields are %s", name, strings.Join(fields, ","))
+			}
+
+			vals[i] = v
+		}
+	}
+
+	if types == nil {
+		m.Values, m.Typed = make([]float64, len(vals)), nil
+
+		for i, v := range vals {
+			m.Values[i] = math.NaN()
+
+			if v != nil && string(v) != "null" && json.Unmarshal(v, &m.Values[i]) != nil {
+				return "type", fmt.Errorf("value %d should be a float, got %s", i, v)
+			}
+		}
+
+		return "", nil
+	}
+
+	if len(vals) > len(types) {
+		return "fields", fmt.Errorf("tag has %d fields, got %d values", len(types), len(vals))
+	}
+
+	m.Values, m.Typed = nil, make([]interface{}, len(types))
+
+	for i, v := range vals {
+		if v == nil || string(v) == "null" {
+			continue
+		}
+
+		var err error
+
+		if m.Typed[i], err = typedValue(types[i], v); err != nil {
+			return "type", fmt.Errorf("field %s should be %s, got %s", fields[i], types[i], v)
+		}
+	}
+
+	return "", nil
+}
+
+// typedValue decodes JSON value `v` of `typ`: float64, int64, bool or
+// string
+func typedValue(typ string, v json.RawMessage) (interface{}, error) {
+	switch typ {
+	case "int":
+		return strconv.ParseInt(string(v), 10, 64)
+	case "bool":
+		var b bool
+		err := json.Unmarshal(v, &b)
+		return b, err
+	case "string":
+		var s string
+		err := json.Unmarshal(v, &s)
+		return s, err
+	}
+
+	var f float64
+	err := json.Unmarshal(v, &f)
+
+	return f, err
+}
+
+// jsonMsg is `m` with NaN values as nulls, for encoding/json, e.g. to
+// forward it to a peer, as easyjson writes NaN, that isn't JSON
+func jsonMsg(m Msg) interface{} {
+	vals := m.Typed
+
+	if vals == nil {
+		vals = nullNaN(m.Values)
+	}
+
+	return struct {
+		Time   int64         `json:"time"`
+		Tag    string        `json:"tag"`
+		Values []interface{} `json:"values"`
+	}{m.Time, m.Tag, vals}
+}
+
+// nullNaN are `vals` with NaNs as nils, that encoding/json writes as nulls
+func nullNaN(vals []float64) []interface{} {
+	res := make([]interface{}, len(vals))
+
+	for i, v := range vals {
+		if !math.IsNaN(v) {
+			res[i] = v
+		}
+	}
+
+	return res
+}
+
+func hasNaN(vals []float64) bool {
+	for _, v := range vals {
+		if math.IsNaN(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func indexOf(fields []string, name string) int {
+	for i, f := range fields {
+		if f == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// projection of values to indexes selected by `fields=<a,b,...>`: names
+// of the tag's schema fields, or indexes, if it has none. `names` are the
+// schema's fields, nil without one
+type projection struct {
+	indexes []int
+	names   []string
+}
+
+// parseFields projects values of stored `tag` by `fields` arg, to all of
+// them without it. responds with 400 on unknown fields
+func parseFields(ctx *fasthttp.RequestCtx, tag string) (projection, bool) {
+	p := projection{names: fieldsOf(tag)}
+	arg := string(ctx.QueryArgs().Peek("fields"))
+
+	if arg == "" {
+		for i := range p.names {
+			p.indexes = append(p.indexes, i)
+		}
+
+		return p, true
+	}
+
+	for _, f := range strings.Split(arg, ",") {
+		i := indexOf(p.names, f)
+
+		if p.names == nil {
+			if n, err := strconv.Atoi(f); err == nil && n >= 0 {
+				i = n
+			}
+		}
+
+		if i < 0 {
+			if p.names == nil {
+				ctx.Error(fmt.Sprintf("tag has no schema, 'fields' should be value indexes, got %q", f), fasthttp.StatusBadRequest)
+			} else {
+				ctx.Error(fmt.Sprintf("unknown field %q, tag's fields are %s", f, strings.Join(p.names, ",")), fasthttp.StatusBadRequest)
+			}
+
+			return p, false
+		}
+
+		p.indexes = append(p.indexes, i)
+	}
+
+	return p, true
+}
+
+// values at selected indexes, that `vals` has
+func (p projection) values(vals []float64) []float64 {
+	if p.indexes == nil {
+		return vals
+	}
+
+	res := make([]float64, 0, len(p.indexes))
+
+	for _, i := range p.indexes {
+		if i < len(vals) {
+			res = append(res, vals[i])
+		}
+	}
+
+	return res
+}
+
+// named values of `s` at selected indexes, skipping nulls
+func (p projection) named(s sample) map[string]interface{} {
+	res := make(map[string]interface{}, len(p.indexes))
+
+	for _, i := range p.indexes {
+		switch {
+		case s.Typed != nil:
+			if i < len(s.Typed) && s.Typed[i] != nil {
+				res[p.names[i]] = s.Typed[i]
+			}
+		case i < len(s.Values) && !math.IsNaN(s.Values[i]):
+			res[p.names[i]] = s.Values[i]
+		}
+	}
+
+	return res
+}
+
+// response of `/api`, with projected values, keyed by field name for tags
+// with a schema
+func (p projection) response(res APIResponse) interface{} {
+	if p.names == nil {
+		if p.indexes == nil {
+			return res
+		}
+
+		var samples Samples
+
+		for _, s := range res.Samples {
+			samples = append(samples, sample{s.Time, p.values(s.Values), nil})
+		}
+
+		res.Samples = samples
+
+		return res
+	}
+
+	var samples []namedSample
+
+	for _, s := range res.Samples {
+		samples = append(samples, namedSample{s.Time, p.named(s)})
+	}
+
+	return namedResponse{res.TagName, res.Start, res.End, samples, res.VisibleUntil}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	kdb "github.com/sv/kdbgo"
+)
+
+func TestTypeValues(t *testing.T) {
+	defer func(schemas []schemaConfig) { conf.Schemas = schemas }(conf.Schemas)
+
+	conf.Schemas = []schemaConfig{
+		{Pattern: "sensor.*", Fields: []string{"temp", "pressure", "humidity"}},
+		{Pattern: "pump.*", Fields: []string{"rpm", "count", "on", "state"}, Types: []string{"float", "int", "bool", "string"}},
+	}
+
+	decode := func(body string) (Msg, string, error) {
+		m, decoded, err := decodeMsg([]byte(body))
+
+		if err != nil {
+			return m, "decode", err
+		}
+
+		reason, err := typeValues(&m, []byte(body), decoded)
+
+		return m, reason, err
+	}
+
+	m, _, err := decode(`{"time":1,"tag":"sensor.1","values":{"humidity":3,"temp":1}}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, m.Values[0])
+	assert.True(t, math.IsNaN(m.Values[1]), "fields without a value should be null")
+	assert.Equal(t, 3.0, m.Values[2])
+	assert.Nil(t, m.Typed)
+
+	p := projection{[]int{1, 0}, fieldsOf("sensor.1")}
+
+	assert.Equal(t, map[string]interface{}{"temp": 1.0}, p.named(sample{1, m.Values, nil}), "nulls should be skipped")
+	assert.Equal(t, []float64{3, 1}, projection{indexes: []int{2, 0, 5}}.values(m.Values), "missing indexes should be skipped")
+
+	m, _, err = decode(`{"time":1,"tag":"pump.1","values":[1.5,7,true,"ok"]}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{1.5, int64(7), true, "ok"}, m.Typed)
+	assert.Nil(t, m.Values)
+
+	m, _, err = decode(`{"time":1,"tag":"pump.1","values":{"state":"off","rpm":null}}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{nil, nil, nil, "off"}, m.Typed, "fields without a value should be nil")
+
+	m, _, err = decode(`{"time":1,"tag":"pump.1","values":[1,2]}`)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{1.0, int64(2), nil, nil}, m.Typed, "easyjson decoded floats should be typed")
+
+	for body, want := range map[string]string{
+		`{"time":1,"tag":"sensor.1","values":{"wind":2}}`:     "fields",
+		`{"time":1,"tag":"t","values":{"temp":2}}`:            "fields",
+		`{"time":1,"tag":"sensor.1","values":[1,"a"]}`:        "type",
+		`{"time":1,"tag":"pump.1","values":[1,2.5]}`:          "type",
+		`{"time":1,"tag":"pump.1","values":{"on":"yes"}}`:     "type",
+		`{"time":1,"tag":"pump.1","values":{"state":1}}`:      "type",
+		`{"time":1,"tag":"pump.1","values":[1,2,true,"a",5]}`: "fields",
+		`{"time":1,"tag":"pump.1","values":"on"}`:             "decode",
+		`{"time":1,"tag":"pump.1"}`:                           "decode",
+	} {
+		_, reason, err := decode(body)
+
+		assert.Error(t, err, body)
+		assert.Equal(t, want, reason, body)
+	}
+
+	forwarded, _ := json.Marshal(jsonMsg(Msg{1, "sensor.1", []float64{1, math.NaN()}, nil}))
+
+	assert.Equal(t, `{"time":1,"tag":"sensor.1","values":[1,null]}`, string(forwarded), "nulls should be forwarded as JSON")
+}
+
+func TestTypedValues(t *testing.T) {
+	defer func(schemas []schemaConfig) { conf.Schemas = schemas }(conf.Schemas)
+
+	conf.Schemas = []schemaConfig{{Pattern: "pump.*", Fields: []string{"rpm", "count", "on", "state"}, Types: []string{"float", "int", "bool", "string"}}}
+
+	td := getTestServer(t)
+
+	now := time.Now().UnixNano()
+	rng := fmt.Sprintf("&start=%d&end=%d", now-int64(time.Minute), now+int64(time.Second))
+
+	rejected := msgRejected.get("type")
+
+	assert.Equal(t, 200, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump.1","values":[1.5,7,true,"running"]}`, now-1)))
+	assert.Equal(t, 200, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump.1","values":{"count":9007199254740993,"state":"stopped"}}`, now)))
+	assert.Equal(t, 400, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump.1","values":{"count":1.5}}`, now)), "type conflicts should be rejected")
+	assert.Equal(t, rejected+1, msgRejected.get("type"))
+
+	td.shard.store.waitRows(t, 2)
+
+	code, body := td.get("/api?tag=pump.1&waitFor=" + fmt.Sprint(now+1) + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Contains(t, body, `"values":{"count":9007199254740993,"state":"stopped"}`, "typed values should keep their type")
+
+	code, body = td.get("/export?tag=pump.1&fields=state,on" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Equal(t, fmt.Sprintf(`{"time":%d,"tag":"pump.1","values":{"on":true,"state":"running"}}`+"\n"+`{"time":%d,"tag":"pump.1","values":{"state":"stopped"}}`+"\n", now-1, now), body)
+
+	rs := rollups(sampleRows("pump.1", td.shard.store.samples("pump.1")), int64(time.Hour))
+
+	assert.Len(t, rs, 1)
+	assert.Equal(t, []interface{}{nil, int64(9007199254740993), nil, "stopped"}, cellTyped(rs[0].last), "typed values should be downsampled to the last one")
+	assert.Equal(t, 7.0, rs[0].min[1], "ints should be aggregated as floats")
+	assert.True(t, math.IsNaN(rs[0].max[3]), "strings shouldn't be aggregated")
+}
+
+// cellTyped are typed values of a values cell
+func cellTyped(k *kdb.K) []interface{} {
+	_, typed, _ := cellValues(k)
+
+	return typed
+}
+
+func TestNamedFields(t *testing.T) {
+	defer func(schemas []schemaConfig) { conf.Schemas = schemas }(conf.Schemas)
+
+	conf.Schemas = []schemaConfig{{Pattern: "sensor.*", Fields: []string{"temp", "pressure"}}}
+
+	td := getTestServer(t)
+
+	now := time.Now().UnixNano()
+	rng := fmt.Sprintf("&start=%d&end=%d", now-int64(time.Minute), now+int64(time.Second))
+
+	assert.Equal(t, 200, td.save(fmt.Sprintf(`{"time":%d,"tag":"sensor.1","values":{"pressure":2}}`, now)))
+	assert.Equal(t, 200, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump","values":[1,2,3]}`, now)))
+	assert.Equal(t, 400, td.save(fmt.Sprintf(`{"time":%d,"tag":"sensor.1","values":{"wind":2}}`, now)), "unknown fields should be rejected")
+	assert.Equal(t, 400, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump","values":{"temp":2}}`, now)), "tags without a schema take arrays only")
+
+	td.shard.store.waitRows(t, 2)
+
+	code, body := td.get("/api?tag=sensor.1&waitFor=" + fmt.Sprint(now+1) + rng)
+
+	var named namedResponse
+
+	assert.Equal(t, 200, code, body)
+	assert.NoError(t, json.Unmarshal([]byte(body), &named))
+	assert.Equal(t, map[string]interface{}{"pressure": 2.0}, named.Samples[len(named.Samples)-1].Values, "values should be keyed by field name")
+
+	code, body = td.get("/api?tag=sensor.1&fields=temp" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Contains(t, body, `"values":{}`, "temp has no value")
+
+	code, body = td.get("/api?tag=pump&fields=2,0" + rng)
+
+	var res APIResponse
+
+	assert.Equal(t, 200, code, body)
+	assert.NoError(t, json.Unmarshal([]byte(body), &res))
+	assert.Equal(t, []float64{3, 1}, res.Samples[len(res.Samples)-1].Values, "values should be selected by index")
+
+	code, body = td.get("/export?tag=sensor.1&fields=pressure,temp" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Equal(t, fmt.Sprintf(`{"time":%d,"tag":"sensor.1","values":{"pressure":2}}`, now), strings.TrimSpace(body), "export should be replayable to /save")
+
+	code, body = td.get("/export?tag=pump&fields=1" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Equal(t, fmt.Sprintf(`{"time":%d,"tag":"pump","values":[2]}`, now), strings.TrimSpace(body))
+
+	code, _ = td.get("/api?tag=sensor.1&fields=wind" + rng)
+
+	assert.Equal(t, 400, code, "unknown fields should be rejected")
+
+	code, _ = td.get("/export?tag=pump&fields=temp" + rng)
+
+	assert.Equal(t, 400, code, "tags without a schema take indexes only")
+}
+
+// nulls of tags without a schema are stored as NaN, that's written as null
+func TestNullValues(t *testing.T) {
+	td := getTestServer(t)
+
+	now := time.Now().UnixNano()
+	rng := fmt.Sprintf("&start=%d&end=%d", now-int64(time.Minute), now+int64(time.Second))
+
+	assert.Equal(t, 200, td.save(fmt.Sprintf(`{"time":%d,"tag":"pump","values":[1,null]}`, now)))
+
+	td.shard.store.waitRows(t, 1)
+
+	code, body := td.get("/api?tag=pump&waitFor=" + fmt.Sprint(now+1) + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.True(t, json.Valid([]byte(body)), body)
+	assert.Contains(t, body, `"values":[1,null]`)
+
+	code, body = td.get("/api?tag=pump&fields=1" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Contains(t, body, `"values":[null]`, "projected nulls should be written too")
+
+	code, body = td.get("/export?tag=pump" + rng)
+
+	assert.Equal(t, 200, code, body)
+	assert.Equal(t, fmt.Sprintf(`{"time":%d,"tag":"pump","values":[1,null]}`, now), strings.TrimSpace(body), "export should be replayable to /save")
+}
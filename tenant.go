@@ -0,0 +1,160 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// tenants share the backend, each in its own tag namespace: `acme` tenant's
+// tag `sensor.1` is stored as `acme:sensor.1`. the default tenant("") keeps
+// tags as they are, and `:` isn't allowed in tags, so namespaces can't
+// overlap
+const tenantSep = ':'
+
+var tenantName = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// tenant of the request, set by `resolveTenant`
+func tenantOf(ctx *fasthttp.RequestCtx) string {
+	t, _ := ctx.UserValue("tenant").(string)
+
+	return t
+}
+
+// resolveTenant sets request tenant: API key's tenant, or `X-Tenant` header
+// for admin keys without one, and when auth is disabled(`auth` is false).
+// other requests use the default tenant. responds with 403 for tenants
+// missing in `tenants`
+func resolveTenant(ctx *fasthttp.RequestCtx, auth bool, tenants map[string]tenantConfig) bool {
+	var t string
+
+	k, ok := ctx.UserValue("apiKey").(*apiKey)
+
+	switch {
+	case ok && k.Tenant != "":
+		t = k.Tenant
+	case !auth || ok && k.can(scopeAdmin):
+		t = string(ctx.Request.Header.Peek("X-Tenant"))
+	}
+
+	if t == "" {
+		return true
+	}
+
+	if _, ok := tenants[t]; !ok {
+		authFailures.inc("tenant")
+		ctx.Error("unknown tenant", fasthttp.StatusForbidden)
+		return false
+	}
+
+	ctx.SetUserValue("tenant", t)
+
+	return true
+}
+
+// validTag tells if `tag` can be namespaced and sent as a q symbol, which
+// can't contain NUL
+func validTag(tag string) bool {
+	return strings.IndexByte(tag, tenantSep) < 0 && strings.IndexByte(tag, 0) < 0
+}
+
+// nsTag is the stored name of the tenant's `tag`
+func nsTag(tenant string, tag string) string {
+	if tenant == "" {
+		return tag
+	}
+
+	return tenant + string(tenantSep) + tag
+}
+
+// splitTag returns tenant and tenant's tag of a stored tag
+func splitTag(stored string) (string, string) {
+	i := strings.IndexByte(stored, tenantSep)
+
+	if i < 0 {
+		return "", stored
+	}
+
+	return stored[:i], stored[i+1:]
+}
+
+// maxLookback for `/api` and `/export` of the tenant: its retention, if
+// it's shorter than `api.maxLookback`
+func maxLookback(tenants map[string]tenantConfig, tenant string) time.Duration {
+	if r := tenants[tenant].Retention; r > 0 && r < conf.API.MaxLookback {
+		return r
+	}
+
+	return conf.API.MaxLookback
+}
+
+func tenantMap(tenants []tenantConfig) map[string]tenantConfig {
+	m := make(map[string]tenantConfig, len(tenants))
+
+	for _, t := range tenants {
+		m[t.Name] = t
+	}
+
+	return m
+}
+
+// quotas enforces tenants' tag count, ingest rate and retention in the
+// consumer, before rows are batched. it's only used by the consumer
+// goroutine, so it doesn't lock
+type quotas struct {
+	tenants map[string]tenantConfig
+	tags    map[string]map[string]bool
+	rate    map[string]*limiter
+}
+
+// newQuotas counts `known` stored tags against their tenants' `maxTags`
+func newQuotas(tenants []tenantConfig, known []string) *quotas {
+	q := &quotas{tenantMap(tenants), make(map[string]map[string]bool), make(map[string]*limiter)}
+
+	for _, t := range tenants {
+		q.tags[t.Name] = make(map[string]bool)
+		q.rate[t.Name] = newLimiter("tenant."+t.Name, rateLimit{t.Rate, t.Burst})
+	}
+
+	for _, tag := range known {
+		if tenant, _ := splitTag(tag); q.tags[tenant] != nil {
+			q.tags[tenant][tag] = true
+		}
+	}
+
+	return q
+}
+
+// accept tells if `m` fits its tenant's quotas, and if not, which one it
+// exceeds
+func (q *quotas) accept(m Msg, now time.Time) (bool, string) {
+	tenant, _ := splitTag(m.Tag)
+
+	t, ok := q.tenants[tenant]
+
+	if !ok {
+		return true, ""
+	}
+
+	if t.Retention > 0 && m.Time < now.Add(-t.Retention).UnixNano() {
+		return false, "retention"
+	}
+
+	if ok, _ := q.rate[tenant].allow(tenant, now.UnixNano()); !ok {
+		return false, "rate"
+	}
+
+	tags := q.tags[tenant]
+
+	if !tags[m.Tag] {
+		if t.MaxTags > 0 && len(tags) >= t.MaxTags {
+			return false, "tags"
+		}
+
+		tags[m.Tag] = true
+	}
+
+	return true, ""
+}
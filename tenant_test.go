@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotas(t *testing.T) {
+	tenants := []tenantConfig{
+		{Name: "acme", MaxTags: 2, Retention: time.Hour},
+		{Name: "globex", Rate: 1, Burst: 2},
+	}
+
+	q := newQuotas(tenants, []string{"acme:a", "other"})
+
+	now := time.Now()
+	ts := now.UnixNano()
+
+	accept := func(tag string, ts int64) string {
+		_, reason := q.accept(Msg{ts, tag, nil, nil}, now)
+		return reason
+	}
+
+	assert.Equal(t, "", accept("acme:a", ts), "known tags should be accepted")
+	assert.Equal(t, "", accept("acme:b", ts))
+	assert.Equal(t, "tags", accept("acme:c", ts), "known tags should count against maxTags")
+	assert.Equal(t, "", accept("acme:b", ts), "existing tags should be accepted after maxTags")
+	assert.Equal(t, "retention", accept("acme:a", now.Add(-2*time.Hour).UnixNano()))
+
+	assert.Equal(t, "", accept("globex:a", ts))
+	assert.Equal(t, "", accept("globex:b", ts))
+	assert.Equal(t, "rate", accept("globex:a", ts), "tenant's rate is shared by its tags")
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "", accept("tag"+string(rune('a'+i)), 0), "default tenant has no quotas")
+	}
+}
+
+// mockDB, that records tags it's queried for
+type tagDB struct {
+	mockDB
+	queried chan string
+}
+
+func (db tagDB) getSeries(tag string, start int64, end int64) (APIResponse, error) {
+	db.queried <- tag
+	return db.mockDB.getSeries(tag, start, end)
+}
+
+func TestTenants(t *testing.T) {
+	defer func(tenants []tenantConfig) { conf.Tenants = tenants }(conf.Tenants)
+
+	conf.Tenants = []tenantConfig{{Name: "acme", Retention: time.Hour}, {Name: "globex"}}
+
+	f, _ := ioutil.TempFile("", "poc-keys")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	writeKeys(t, f.Name(), `
+keys:
+  - name: acme
+    key: acme-key
+    tenant: acme
+    scopes: [ingest, query]
+  - name: globex
+    key: globex-key
+    tenant: globex
+    scopes: [ingest, query]
+  - name: ops
+    key: ops-key
+    scopes: [ingest, query]
+  - name: admin
+    key: admin-key
+    scopes: [ingest, query, admin]
+`)
+
+	keys, err := loadKeys(f.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := tagDB{queried: make(chan string, 1)}
+	in := make(chan Msg, 10)
+	c := getServer(db, newIntake(in), keys, nil, nil, nil).c
+
+	msg := `{"time":1000,"tag":"sensor.1","values":[1.1]}`
+
+	assert.Equal(t, 200, doWithKey(c, "POST", "http://test.me/save", "acme-key", msg))
+	assert.Equal(t, "acme:sensor.1", (<-in).Tag, "tag should be namespaced with key's tenant")
+
+	assert.Equal(t, 200, doWithKey(c, "POST", "http://test.me/save", "ops-key", msg))
+	assert.Equal(t, "sensor.1", (<-in).Tag, "default tenant's tags are stored as they are")
+
+	assert.Equal(t, 400, doWithKey(c, "POST", "http://test.me/save", "ops-key", `{"time":1000,"tag":"acme:sensor.1","values":[1.1]}`), "tags can't escape their namespace")
+	assert.Equal(t, 0, len(in))
+
+	_, body := request(c, "GET", "http://test.me/tags", "acme-key", "")
+	assert.JSONEq(t, `["sensor.1","test_tag"]`, body)
+
+	_, body = request(c, "GET", "http://test.me/tags?prefix=test", "acme-key", "", "X-Tenant", "globex")
+	assert.JSONEq(t, `["test_tag"]`, body, "key's tenant should win over X-Tenant")
+
+	_, body = request(c, "GET", "http://test.me/tags", "admin-key", "", "X-Tenant", "globex")
+	assert.JSONEq(t, `["test_tag"]`, body, "admin keys without a tenant can pick one")
+
+	_, body = request(c, "GET", "http://test.me/tags", "ops-key", "", "X-Tenant", "other")
+	assert.JSONEq(t, `["other","test_tag","test_tag2"]`, body, "other keys without a tenant should stay in the default one")
+
+	_, body = request(c, "GET", "http://test.me/tags", "ops-key", "")
+	assert.JSONEq(t, `["other","test_tag","test_tag2"]`, body, "default tenant shouldn't see others' tags")
+
+	code, _ := request(c, "GET", "http://test.me/tags", "admin-key", "", "X-Tenant", "initech")
+	assert.Equal(t, 403, code, "unknown tenants should be rejected")
+
+	api := "http://test.me/api?tag=test_tag&end=" + formatNow(0) + "&start="
+
+	code, body = request(c, "GET", api+formatNow(-30*time.Minute), "globex-key", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "globex:test_tag", <-db.queried)
+	assert.Contains(t, body, `"tagName":"test_tag"`, "response should have tenant's tag")
+
+	code, _ = request(c, "GET", api+formatNow(-2*time.Hour), "acme-key", "")
+	assert.Equal(t, 400, code, "can't query past tenant's retention")
+
+	code, body = request(c, "GET", "http://test.me/export?tag=sensor.1&end="+formatNow(0)+"&start="+formatNow(-30*time.Minute), "acme-key", "")
+	assert.Equal(t, 200, code)
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+
+	assert.Len(t, lines, 2, "should return a line per row")
+	assert.Contains(t, lines[1], `"tag":"sensor.1","values":[2,3]`, "rows should be in /save format")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipher policies for TLS 1.2 and older, TLS 1.3 suites aren't configurable.
+// "default" leaves the choice to Go
+var tlsCiphers = map[string][]uint16{
+	"default": nil,
+	"modern": {
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	},
+}
+
+var tlsClientAuth = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// tlsStore holds TLS config built from `tls.*` settings, and rebuilds it
+// once the certificate, key or client CA files change. new connections get
+// the current config, established ones keep theirs
+type tlsStore struct {
+	c      tlsConfig
+	config atomic.Value // *tls.Config
+}
+
+// loadTLS reads certificate, key and client CA files of `c`
+func loadTLS(c tlsConfig) (*tlsStore, error) {
+	ts := &tlsStore{c: c}
+
+	if err := ts.reload(); err != nil {
+		return nil, err
+	}
+
+	return ts, nil
+}
+
+func (ts *tlsStore) files() []string {
+	files := []string{ts.c.CertFile, ts.c.KeyFile}
+
+	if ts.c.ClientCAFile != "" {
+		files = append(files, ts.c.ClientCAFile)
+	}
+
+	return files
+}
+
+// reload replaces the config, keeping the old one if any of the files can't
+// be read or is invalid
+func (ts *tlsStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(ts.c.CertFile, ts.c.KeyFile)
+
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tlsVersions[ts.c.MinVersion],
+		CipherSuites: tlsCiphers[ts.c.Ciphers],
+		ClientAuth:   tlsClientAuth[ts.c.ClientAuth],
+	}
+
+	if ts.c.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(ts.c.ClientCAFile)
+
+		if err != nil {
+			return err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", ts.c.ClientCAFile)
+		}
+	}
+
+	ts.config.Store(config)
+
+	return nil
+}
+
+// watch reloads the config once any of its files change, checking them
+// each `interval`. runs forever, meant to be started in a goroutine
+func (ts *tlsStore) watch(interval time.Duration) {
+	watchFiles("TLS", interval, ts.reload, ts.files()...)
+}
+
+// serverConfig for `tls.NewListener`, handing out the current config to
+// each new connection
+func (ts *tlsStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return ts.config.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// clientCertName is the common name of a verified client certificate,
+// empty for plain connections and connections without one
+func clientCertName(ctx *fasthttp.RequestCtx) string {
+	if !ctx.IsTLS() {
+		return ""
+	}
+
+	state := ctx.TLSConnectionState()
+
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// testCert is a certificate signed by `parent`, self-signed if it's nil
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, serial int64, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"test.me"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// writes server cert, key and CA files to `dir`, with a future mtime, so
+// watchers notice the change on filesystems with coarse timestamps
+func writeTLSFiles(t *testing.T, dir string, server *testCert, ca *testCert, mtime time.Time) tlsConfig {
+	c := defaultConfig().TLS
+	c.CertFile = filepath.Join(dir, "cert.pem")
+	c.KeyFile = filepath.Join(dir, "key.pem")
+	c.ClientCAFile = filepath.Join(dir, "ca.pem")
+	c.ClientAuth = "optional"
+
+	for path, data := range map[string][]byte{c.CertFile: server.certPEM(), c.KeyFile: server.keyPEM(t), c.ClientCAFile: ca.certPEM()} {
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	return c
+}
+
+// TLS client of a server on in-memory listener, presenting `client` cert
+// if it's not nil
+func tlsClient(ln *fasthttputil.InmemoryListener, ca *testCert, client *tls.Certificate) (*fasthttp.Client, *tls.ConnectionState) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: roots, ServerName: "test.me"}
+
+	if client != nil {
+		config.Certificates = []tls.Certificate{*client}
+	}
+
+	state := &tls.ConnectionState{}
+
+	c := &fasthttp.Client{
+		Dial: func(addr string) (net.Conn, error) {
+			conn, err := ln.Dial()
+
+			if err != nil {
+				return nil, err
+			}
+
+			tc := tls.Client(conn, config)
+
+			if err := tc.Handshake(); err != nil {
+				return nil, err
+			}
+
+			*state = tc.ConnectionState()
+
+			return tc, nil
+		},
+	}
+
+	return c, state
+}
+
+func getTLSTestServer(t *testing.T, c tlsConfig, keys *keyStore) (*fasthttputil.InmemoryListener, *tlsStore, chan Msg) {
+	certs, err := loadTLS(c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := mockDB{}
+	in := db.startQueueConsumer()
+
+	ln := fasthttputil.NewInmemoryListener()
+	serveMux(tls.NewListener(ln, certs.serverConfig()), db, newIntake(in), keys, nil, nil, nil)
+
+	return ln, certs, in
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "poc-tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "test CA", 1, nil)
+	server := newTestCert(t, "test.me", 2, ca)
+	producer := newTestCert(t, "producer1", 3, ca).tlsCert(t)
+	stranger := newTestCert(t, "producer1", 4, nil).tlsCert(t)
+
+	keysFile := filepath.Join(dir, "keys.yml")
+	writeKeys(t, keysFile, "keys:\n  - name: producer\n    cert: producer1\n    scopes: [ingest]\n    tags: [sensor.]\n")
+
+	keys, err := loadKeys(keysFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, _, in := getTLSTestServer(t, writeTLSFiles(t, dir, server, ca, time.Now()), keys)
+
+	msg := `{"time":1000,"tag":"sensor.1","values":[1.1]}`
+
+	c, _ := tlsClient(ln, ca, &producer)
+
+	assert.Equal(t, 200, doWithKey(c, "POST", "http://test.me/save", "", msg), "client cert should be authorized as its key")
+	assert.Equal(t, "sensor.1", (<-in).Tag)
+	assert.Equal(t, 403, doWithKey(c, "POST", "http://test.me/save", "", `{"time":1000,"tag":"other","values":[1.1]}`), "cert key's tags should apply")
+
+	c, _ = tlsClient(ln, ca, nil)
+
+	assert.Equal(t, 401, doWithKey(c, "POST", "http://test.me/save", "", msg), "no client cert, no key")
+	assert.Equal(t, 200, doWithKey(c, "GET", "http://test.me/health/live", "", ""), "TLS without client cert should work")
+
+	c, _ = tlsClient(ln, ca, &stranger)
+
+	assert.Equal(t, 401, doWithKey(c, "POST", "http://test.me/save", "", msg), "certs of unknown CA shouldn't be authorized")
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "poc-tls")
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "test CA", 1, nil)
+
+	c := writeTLSFiles(t, dir, newTestCert(t, "test.me", 2, ca), ca, time.Now())
+
+	ln, certs, _ := getTLSTestServer(t, c, nil)
+
+	go certs.watch(10 * time.Millisecond)
+
+	client, state := tlsClient(ln, ca, nil)
+
+	assert.Equal(t, 200, doWithKey(client, "GET", "http://test.me/health/live", "", ""))
+	assert.Equal(t, int64(2), state.PeerCertificates[0].SerialNumber.Int64())
+
+	writeTLSFiles(t, dir, newTestCert(t, "test.me", 5, ca), ca, time.Now().Add(time.Second))
+
+	serial := int64(0)
+
+	for i := 0; i < 100 && serial != 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		// new client for a new connection
+		client, state = tlsClient(ln, ca, nil)
+		doWithKey(client, "GET", "http://test.me/health/live", "", "")
+		serial = state.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	assert.Equal(t, int64(5), serial, "new connections should get the new certificate")
+
+	ioutil.WriteFile(c.KeyFile, []byte("broken"), 0600)
+	os.Chtimes(c.KeyFile, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+
+	time.Sleep(50 * time.Millisecond)
+
+	client, state = tlsClient(ln, ca, nil)
+
+	assert.Equal(t, 200, doWithKey(client, "GET", "http://test.me/health/live", "", ""), "should keep serving the old certificate")
+	assert.Equal(t, int64(5), state.PeerCertificates[0].SerialNumber.Int64())
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	_, err := loadConfig([]string{"-tls.certFile", "cert.pem", "-tls.minVersion", "2.0", "-tls.clientAuth", "require"})
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "tls.certFile and tls.keyFile should be set together")
+	assert.Contains(t, err.Error(), "tls.minVersion")
+	assert.Contains(t, err.Error(), "tls.clientAuth require needs tls.clientCAFile")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// acknowledged batches kept per worker until hdb sees them. they're only
+// dropped on queries, so without queries the oldest ones are forgotten
+const maxAckedBatches = 1000
+
+// visibility tracks the ingest watermark: messages, that `/save` accepted
+// before it, are persisted and visible to hdb queries.
+//
+// the consumer samples msgChan each tick: once it took as many messages as
+// were queued at a sample, everything accepted before the sample is
+// `drained`. a batch's `floor` is `drained` when its first row was taken,
+// so none of its rows was accepted before it. a batch stops holding the
+// watermark back, once its shard's hdb watermark passes its ack time. as
+// `drained` only grows, each worker's oldest batch has the lowest floor
+type visibility struct {
+	mu      sync.Mutex
+	drained int64
+	// msgChan samples, that aren't drained yet
+	samples []drainSample
+	// floor of each worker's partial batch, 0 if it's empty
+	partial []int64
+	// floors of batches queued or being sent, by worker, oldest first
+	sending [][]int64
+	// batches tp acknowledged, that hdb may not see yet, by worker
+	acked [][]ackedBatch
+}
+
+type drainSample struct {
+	at int64
+	// messages taken, once every message queued at `at` was taken
+	taken int64
+}
+
+type ackedBatch struct {
+	floor int64
+	at    int64
+}
+
+func newVisibility(workers int) *visibility {
+	return &visibility{drained: time.Now().UnixNano(), partial: make([]int64, workers), sending: make([][]int64, workers), acked: make([][]ackedBatch, workers)}
+}
+
+// sample records `queued` messages in msgChan at `now`, with `taken`
+// messages taken from it so far
+func (v *visibility) sample(now int64, queued int, taken int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.samples = append(v.samples, drainSample{now, taken + int64(queued)})
+
+	n := 0
+
+	for n < len(v.samples) && v.samples[n].taken <= taken {
+		v.drained = v.samples[n].at
+		n++
+	}
+
+	v.samples = v.samples[n:]
+}
+
+// start is called before the first row is added to the worker's batch
+func (v *visibility) start(worker int) {
+	v.mu.Lock()
+	v.partial[worker] = v.drained
+	v.mu.Unlock()
+}
+
+// flush moves the worker's partial batch to the ones being sent
+func (v *visibility) flush(worker int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.sending[worker] = append(v.sending[worker], v.partial[worker])
+	v.partial[worker] = 0
+}
+
+// ack marks the worker's oldest batch being sent as acknowledged by tp at `at`
+func (v *visibility) ack(worker int, at int64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	floor := v.sending[worker][0]
+	v.sending[worker] = v.sending[worker][1:]
+
+	v.acked[worker] = append(v.acked[worker], ackedBatch{floor, at})
+
+	if len(v.acked[worker]) > maxAckedBatches {
+		v.acked[worker] = v.acked[worker][1:]
+	}
+}
+
+// until is the watermark of `workers`, whose shard's hdb sees batches
+// acknowledged before `hdb`
+func (v *visibility) until(workers []int, hdb int64) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	wm := v.drained
+
+	for _, w := range workers {
+		acked := v.acked[w]
+
+		for len(acked) > 0 && acked[0].at <= hdb {
+			acked = acked[1:]
+		}
+
+		v.acked[w] = acked
+
+		floor := v.partial[w]
+
+		if len(v.sending[w]) > 0 {
+			floor = v.sending[w][0]
+		}
+
+		if len(acked) > 0 {
+			floor = acked[0].floor
+		}
+
+		if floor != 0 && floor < wm {
+			wm = floor
+		}
+	}
+
+	return wm
+}
+
+// how often a shard's hdb watermark is polled, while requests or batches wait for it
+const visiblePoll = 50 * time.Millisecond
+
+// how long ingest lag of a batch is waited for, it's observed as is after it
+const maxLagWait = time.Minute
+
+// watermarkPoll shares hdb watermark queries of a shard between requests
+// waiting for it: while there are waiters, one goroutine polls it each
+// `visiblePoll`, and wakes them up
+type watermarkPoll struct {
+	mu      sync.Mutex
+	waiters int
+	running bool
+	// last polled watermark, 0 until the first poll
+	wm int64
+	// closed after the next poll
+	polled chan struct{}
+}
+
+func newWatermarkPoll() *watermarkPoll {
+	return &watermarkPoll{polled: make(chan struct{})}
+}
+
+// join adds a waiter, starting to `poll`, unless it's polled already
+func (p *watermarkPoll) join(poll func() (int64, error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.waiters++
+
+	if !p.running {
+		p.running = true
+		go p.run(poll)
+	}
+}
+
+func (p *watermarkPoll) leave() {
+	p.mu.Lock()
+	p.waiters--
+	p.mu.Unlock()
+}
+
+// last is the last polled watermark, and a channel closed after the next poll
+func (p *watermarkPoll) last() (int64, chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.wm, p.polled
+}
+
+// run polls, until there are no waiters. failed polls keep the last watermark
+func (p *watermarkPoll) run(poll func() (int64, error)) {
+	for {
+		wm, err := poll()
+
+		p.mu.Lock()
+
+		if err == nil {
+			p.wm = wm
+		}
+
+		close(p.polled)
+		p.polled = make(chan struct{})
+
+		if p.waiters == 0 {
+			p.running = false
+			p.mu.Unlock()
+
+			return
+		}
+
+		p.mu.Unlock()
+
+		time.Sleep(visiblePoll)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVisibilityWatermark(t *testing.T) {
+	v := newVisibility(2)
+	v.drained = 100
+
+	// 3 messages queued at 200, 2 of them taken
+	v.sample(200, 1, 2)
+
+	assert.Equal(t, int64(100), v.until([]int{0, 1}, 0), "messages queued at 200 aren't taken yet")
+
+	v.start(0)
+	v.sample(300, 0, 3)
+
+	assert.Equal(t, int64(100), v.until([]int{0, 1}, 0), "partial batch should hold the watermark")
+	assert.Equal(t, int64(300), v.until([]int{1}, 0), "other workers' batches shouldn't hold it")
+
+	v.flush(0)
+	v.start(0)
+	v.ack(0, 400)
+
+	assert.Equal(t, int64(100), v.until([]int{0}, 399), "hdb doesn't see the acknowledged batch yet")
+	assert.Equal(t, int64(300), v.until([]int{0}, 400), "the next partial batch should hold the watermark")
+
+	v.flush(0)
+	v.ack(0, 500)
+
+	assert.Equal(t, int64(300), v.until([]int{0}, 499))
+	assert.Equal(t, int64(300), v.until([]int{0}, 500), "nothing is pending, up to the last drained sample")
+}